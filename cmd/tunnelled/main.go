@@ -4,15 +4,25 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	"tunnelled/internal/bans"
 	"tunnelled/internal/config"
+	"tunnelled/internal/control"
+	"tunnelled/internal/ddns"
+	"tunnelled/internal/dns"
 	"tunnelled/internal/http"
 	"tunnelled/internal/ip"
 	"tunnelled/internal/net"
 	"tunnelled/internal/net/dialer"
+	"tunnelled/internal/portmap"
+	"tunnelled/internal/provision"
 	"tunnelled/internal/router"
 	"tunnelled/internal/util"
 	"tunnelled/internal/version"
+	"tunnelled/internal/webhook"
 
 	"github.com/gin-gonic/gin"
 )
@@ -34,11 +44,35 @@ func main() {
 	_, err := dialer.FireUpClient()
 	if err != nil {
 		panic(errors.Join(errors.New("failed to start dialer client"), err))
-		return
 	}
 
 	isServer := *appType == "server"
 
+	// Configuration is loaded before the listeners so webhooks don't miss startup events
+	var serverConfig *config.ServerConfig
+	var clientConfig *config.ClientConfig
+	var webhooks []config.WebhookConfig
+	if isServer {
+		serverConfig, err = config.LoadServerConfig()
+		if err != nil {
+			panic(fmt.Errorf("failed to load server config: %v", err))
+		}
+		webhooks = serverConfig.Webhooks
+		ip.NotifyFailedThreshold = serverConfig.IPNotifyFailedAfter
+	} else {
+		clientConfig, err = config.LoadClientConfig()
+		if err != nil {
+			panic(fmt.Errorf("failed to load client config: %v", err))
+		}
+		webhooks = clientConfig.Webhooks
+		net.TunnelDownThreshold = time.Duration(clientConfig.TunnelDownAfter) * time.Second
+	}
+
+	err = webhook.Start(webhooks)
+	if err != nil {
+		panic(errors.Join(errors.New("failed to start webhooks"), err))
+	}
+
 	rm := router.NewManager()
 	rm.Routes.Range(func(key, value any) bool {
 		route, ok := value.(*router.Route)
@@ -46,38 +80,78 @@ func main() {
 			return true
 		}
 
-		listener := &net.Listener{
-			Route:    route,
-			IsServer: isServer,
-		}
-		go listener.FireUp()
+		net.StartListener(route, isServer)
 		return true
 	})
 
 	if *appType == "server" {
-		fireUpServer(rm)
+		fireUpServer(rm, serverConfig)
 	}
 
 	if *appType == "client" {
-		fireUpClient(rm)
+		fireUpClient(rm, clientConfig)
 	}
 }
 
-func fireUpServer(rm *router.Manager) {
-	// Load server configuration
-	serverConfig, err := config.LoadServerConfig()
-	if err != nil {
-		panic(fmt.Errorf("failed to load server config: %v", err))
+func fireUpServer(rm *router.Manager, serverConfig *config.ServerConfig) {
+	loadBans(serverConfig.AutoBan)
+	// Every tunnel comes from a client edge, banning one would take all of its routes down
+	if len(serverConfig.Clients) == 0 {
+		bans.Exempt(serverConfig.ClientEndpoint, serverConfig.ClientControl)
+	}
+	for _, client := range serverConfig.Clients {
+		bans.Exempt(client.Endpoint, client.Control)
+	}
+
+	if serverConfig.AdminAddress != "" {
+		go http.NewAdminServer(serverConfig.AdminAddress)
 	}
 
 	// Initialize IP discovery service
-	discoveryService := ip.NewDiscoveryService(serverConfig.IPCheckInterval)
+	discoveryService, err := ip.NewDiscoveryService(serverConfig.IPCheckInterval, serverConfig.IPDiscovery)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize IP discovery: %v", err))
+	}
+
+	var portMapper *portmap.Service
+	if serverConfig.PortMapping.Enabled {
+		portMapper = portmap.NewService(serverConfig.PortMapping, rm)
+		portMapper.Start()
+		discoveryService.SetWANSource(portMapper)
+		if serverConfig.PortMapping.IPSource {
+			discoveryService.AddProvider(portMapper)
+		}
+	}
+
+	// Initialize IP notifier, it delivers IP changes in the background until every client acknowledges them.
+	// Clients without their own token use ours (should be same as client's .token file)
+	notifier, err := ip.NewIPNotifier(rm, serverConfig, http.ReadToken())
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize IP notifier: %v", err))
+	}
 
-	// Get client bearer token (should be same as client's .token file)
-	clientBearerToken := "Bearer " + http.ReadToken()
+	// Sessions are only handed over to tunnels signed with the token of a client
+	tunnelKeys := []string{http.ReadToken()}
+	for _, client := range serverConfig.Clients {
+		tunnelKeys = append(tunnelKeys, client.Token)
+	}
+	err = net.SetTunnelKeys(tunnelKeys...)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize tunnel handovers: %v", err))
+	}
+	notifier.Run()
+
+	ddnsService, err := ddns.NewService(serverConfig.DDNS)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize DDNS: %v", err))
+	}
+	ddnsService.Start()
 
-	// Initialize IP notifier
-	notifier := ip.NewIPNotifier(rm, serverConfig.ClientEndpoint, clientBearerToken)
+	http.SetRemoteAdmin(notifier.Admin)
+	http.RegisterStatus("clients", func() any { return notifier.Status() })
+	http.RegisterStatus("public_ip", func() any { return discoveryService.GetCurrentIP() })
+	http.RegisterStatus("nat", func() any { return discoveryService.GetNATReport() })
+	http.RegisterStatus("ddns", func() any { return ddnsService.Status() })
 
 	// Start IP monitoring goroutine
 	go func() {
@@ -90,10 +164,11 @@ func fireUpServer(rm *router.Manager) {
 			fmt.Printf("Initial IP check failed: %v\n", err)
 		} else if changed {
 			fmt.Printf("Initial public IP: %s\n", currentIP)
-			err = notifier.NotifyClientOfIPChange(currentIP)
-			if err != nil {
-				fmt.Printf("Failed to notify client of initial IP: %v\n", err)
+			if _, err := discoveryService.CheckNAT(); err != nil {
+				fmt.Println(err)
 			}
+			notifier.SetIP(currentIP)
+			ddnsService.SetIP(currentIP)
 		}
 
 		// Periodic IP checks
@@ -105,19 +180,70 @@ func fireUpServer(rm *router.Manager) {
 			}
 
 			if changed {
-				err = notifier.NotifyClientOfIPChange(newIP)
-				if err != nil {
-					fmt.Printf("Failed to notify client of IP change: %v\n", err)
+				if _, err := discoveryService.CheckNAT(); err != nil {
+					fmt.Println(err)
 				}
+				notifier.SetIP(newIP)
+				ddnsService.SetIP(newIP)
 			}
 		}
 	}()
 
-	// in server mode, we need to lock down the process to keep gnet running
-	select {}
+	// in server mode, we need to lock down the process to keep gnet running, until we're asked to stop
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Println("Shutting down")
+	// Forwards left on the router would keep the ports open to whatever takes them next
+	if portMapper != nil {
+		portMapper.Stop()
+	}
 }
 
-func fireUpClient(rm *router.Manager) {
+func fireUpClient(rm *router.Manager, clientConfig *config.ClientConfig) {
 	fmt.Printf("Router > Loaded %d routes\n", util.LenSyncMap(rm.Routes))
-	http.NewHTTPServer(rm)
+	// Live sessions follow backend updates right away
+	rm.AddBackendListener(net.MigrateRoute)
+	dns.NewBackendTracker(rm, clientConfig.BackendDNS).Start()
+
+	loadBans(clientConfig.AutoBan)
+	err := net.SetTunnelKeys(http.ReadToken())
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize tunnel handovers: %v", err))
+	}
+
+	// Servers push IP changes and admin commands over the control channel, the HTTP API is the fallback
+	if clientConfig.ControlAddress != "" {
+		// Servers with their own token are identified by it, whatever name they declare
+		credentials := make(map[string]string)
+		for server, policy := range clientConfig.Provisioning {
+			if policy.Token != "" {
+				credentials[server] = policy.Token
+			}
+		}
+		controlListener := control.NewListener(clientConfig.ControlAddress, http.ReadToken(), credentials)
+		ip.RegisterControlHandlers(controlListener, rm)
+		http.RegisterControlAdmin(controlListener, rm)
+		provision.NewProvisioner(rm, clientConfig.Provisioning).Register(controlListener)
+		http.RegisterStatus("control", func() any { return controlListener.Sessions() })
+		go func() {
+			err := controlListener.Serve()
+			if err != nil {
+				fmt.Printf("Control > Listener stopped: %v\n", err)
+			}
+		}()
+	}
+	http.NewHTTPServer(rm, clientConfig)
+}
+
+// loadBans restores the saved bans and sets up the automatic ones
+func loadBans(autoBan config.AutoBanConfig) {
+	err := bans.Load()
+	if err != nil {
+		panic(fmt.Errorf("failed to load bans: %v", err))
+	}
+	err = bans.ConfigureAutoBan(autoBan)
+	if err != nil {
+		panic(fmt.Errorf("failed to configure auto bans: %v", err))
+	}
 }
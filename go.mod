@@ -5,6 +5,8 @@ go 1.25
 require (
 	github.com/gin-gonic/gin v1.11.0
 	github.com/panjf2000/gnet/v2 v2.9.4
+	golang.org/x/net v0.42.0
+	golang.org/x/sys v0.37.0
 )
 
 require (
@@ -37,9 +39,7 @@ require (
 	golang.org/x/arch v0.20.0 // indirect
 	golang.org/x/crypto v0.40.0 // indirect
 	golang.org/x/mod v0.25.0 // indirect
-	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
-	golang.org/x/sys v0.37.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
 	google.golang.org/protobuf v1.36.9 // indirect
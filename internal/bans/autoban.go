@@ -0,0 +1,217 @@
+package bans
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/events"
+	"tunnelled/internal/metrics"
+	"tunnelled/internal/util"
+)
+
+// Offences scored by the auto ban
+const (
+	OffenceProxyHeader        = "proxy_header"        // malformed, refused, missing or untrusted PROXY header
+	OffenceTunnelHandshake    = "tunnel_handshake"    // first packet of a tunnel that isn't an ID or probe packet
+	OffenceMinecraftHandshake = "minecraft_handshake" // invalid Minecraft handshake
+)
+
+var defaultScores = map[string]int{
+	OffenceProxyHeader:        1,
+	OffenceTunnelHandshake:    1,
+	OffenceMinecraftHandshake: 1,
+}
+
+type offence struct {
+	kind  string
+	score int
+	at    time.Time
+}
+
+// Offences of every IP within the window, auto bans are disabled until ConfigureAutoBan is called
+var (
+	autoBan       config.AutoBanConfig
+	ignored       []*net.IPNet
+	offences      = make(map[string][]offence) // IP -> offences, oldest first
+	lastPrune     time.Time
+	offencesMutex sync.Mutex
+)
+
+// ConfigureAutoBan sets up the scoring of protocol errors
+func ConfigureAutoBan(cfg config.AutoBanConfig) error {
+	if cfg.Threshold < 0 || cfg.Window < 0 || cfg.BanTime < 0 {
+		return errors.New("auto ban threshold, window and ban time cannot be negative")
+	}
+	for kind := range cfg.Scores {
+		if _, ok := defaultScores[kind]; !ok {
+			return fmt.Errorf("unknown auto ban offence %s", kind)
+		}
+	}
+
+	var networks []*net.IPNet
+	for _, entry := range cfg.Ignore {
+		network, err := util.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid auto ban ignored range: %v", err)
+		}
+		networks = append(networks, network)
+	}
+
+	offencesMutex.Lock()
+	defer offencesMutex.Unlock()
+	autoBan = cfg
+	ignored = networks
+	return nil
+}
+
+// Report scores a protocol error of an IP, banning it once its score within the window reaches the threshold
+func Report(ip net.IP, kind, routeID string) {
+	if ip == nil {
+		return
+	}
+
+	offencesMutex.Lock()
+	if autoBan.Threshold <= 0 || isIgnoredLocked(ip) {
+		offencesMutex.Unlock()
+		return
+	}
+	score, ok := autoBan.Scores[kind]
+	if !ok {
+		score = defaultScores[kind]
+	}
+	if score <= 0 {
+		offencesMutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	window := time.Duration(autoBan.Window) * time.Second
+	if now.Sub(lastPrune) > window {
+		pruneLocked(now, window)
+	}
+
+	key := ip.String()
+	recent := append(inWindow(offences[key], now, window), offence{kind: kind, score: score, at: now})
+	total := 0
+	counts := make(map[string]int)
+	for _, o := range recent {
+		total += o.score
+		counts[o.kind]++
+	}
+	if total < autoBan.Threshold {
+		offences[key] = recent
+		offencesMutex.Unlock()
+		return
+	}
+	delete(offences, key)
+	ttl := time.Duration(autoBan.BanTime) * time.Second
+	offencesMutex.Unlock()
+
+	// Connections opened before a ban keep reporting errors, the IP may already be banned
+	if Check(ip) != nil {
+		return
+	}
+
+	reason := "repeated protocol errors: " + describe(counts)
+	ban, err := Add(key, ttl, reason, "auto")
+	if err != nil {
+		fmt.Printf("Bans > Failed to save auto ban of %s: %v\n", key, err)
+	}
+	if ban == nil {
+		return
+	}
+	metrics.Inc(metrics.AutoBanned, routeID)
+	events.Publish(events.Event{
+		Type:    events.IPAutoBanned,
+		RouteID: routeID,
+		Data:    map[string]any{"network": ban.Network, "score": total, "offences": counts, "expires_at": ban.ExpiresAt},
+	})
+}
+
+// Exempt keeps hosts (IPs, names, host:port or URLs) from ever being auto banned, like the tunnelled-clients
+// of a server, which are the peers of every tunnel. Names are resolved once.
+func Exempt(hosts ...string) {
+	var networks []*net.IPNet
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if u, err := url.Parse(host); err == nil && u.Host != "" {
+			host = u.Hostname()
+		} else if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			var err error
+			ips, err = net.LookupIP(host)
+			if err != nil {
+				fmt.Printf("Bans > Cannot exempt %s from auto bans: %v\n", host, err)
+				continue
+			}
+		}
+		for _, ip := range ips {
+			network, err := util.ParseCIDR(ip.String())
+			if err == nil {
+				networks = append(networks, network)
+			}
+		}
+	}
+
+	offencesMutex.Lock()
+	defer offencesMutex.Unlock()
+	ignored = append(ignored, networks...)
+}
+
+func isIgnoredLocked(ip net.IP) bool {
+	for _, network := range ignored {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// inWindow returns the offences that happened within the window
+func inWindow(list []offence, now time.Time, window time.Duration) []offence {
+	for i, o := range list {
+		if now.Sub(o.at) <= window {
+			return list[i:]
+		}
+	}
+	return nil
+}
+
+// pruneLocked forgets the IPs without offences in the window, so scanners passing by don't grow the map forever
+func pruneLocked(now time.Time, window time.Duration) {
+	for key, list := range offences {
+		if recent := inWindow(list, now, window); len(recent) > 0 {
+			offences[key] = recent
+		} else {
+			delete(offences, key)
+		}
+	}
+	lastPrune = now
+}
+
+// describe formats offence counts like "3 proxy_header, 2 tunnel_handshake"
+func describe(counts map[string]int) string {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+	}
+	return strings.Join(parts, ", ")
+}
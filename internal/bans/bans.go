@@ -0,0 +1,191 @@
+package bans
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"tunnelled/internal/events"
+	"tunnelled/internal/util"
+)
+
+var bansFile = "bans.json"
+
+// Ban refuses the connections of an IP or a range, until it expires
+type Ban struct {
+	Network   string     `json:"network"` // banned IP or CIDR
+	Reason    string     `json:"reason,omitempty"`
+	Source    string     `json:"source,omitempty"` // who added it, like "admin"
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // permanent if nil
+
+	network *net.IPNet
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt)
+}
+
+// Matches reports whether a player IP is covered by the ban
+func (b *Ban) Matches(ip net.IP) bool {
+	return ip != nil && b.network.Contains(ip)
+}
+
+var (
+	bans      = make(map[string]*Ban) // network -> ban
+	bansMutex sync.RWMutex
+)
+
+// Load reads the bans saved by a previous run, expired ones are dropped
+func Load() error {
+	data, err := os.ReadFile(bansFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []*Ban
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal bans file: %v", err)
+	}
+
+	bansMutex.Lock()
+	defer bansMutex.Unlock()
+	now := time.Now()
+	for _, ban := range saved {
+		if ban.expired(now) {
+			continue
+		}
+		ban.network, err = util.ParseCIDR(ban.Network)
+		if err != nil {
+			fmt.Printf("Bans > Ignoring ban of %s: %v\n", ban.Network, err)
+			continue
+		}
+		bans[ban.network.String()] = ban
+	}
+	fmt.Printf("Bans > Loaded %d bans\n", len(bans))
+	return nil
+}
+
+// Add bans an IP or a range for ttl (forever if 0), replacing any ban of the same network
+func Add(entry string, ttl time.Duration, reason, source string) (*Ban, error) {
+	network, err := util.ParseCIDR(strings.TrimSpace(entry))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ban := &Ban{
+		Network:   network.String(),
+		Reason:    reason,
+		Source:    source,
+		CreatedAt: now,
+		network:   network,
+	}
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		ban.ExpiresAt = &expiresAt
+	}
+
+	bansMutex.Lock()
+	bans[ban.Network] = ban
+	err = saveLocked()
+	bansMutex.Unlock()
+
+	fmt.Printf("Bans > Banned %s (%s): %s\n", ban.Network, source, reason)
+	events.Publish(events.Event{
+		Type: events.IPBanned,
+		Data: map[string]any{"network": ban.Network, "reason": reason, "source": source, "expires_at": ban.ExpiresAt},
+	})
+	return ban, err
+}
+
+// Remove lifts the ban of an IP or a range, it reports whether there was one
+func Remove(entry string) (bool, error) {
+	network, err := util.ParseCIDR(strings.TrimSpace(entry))
+	if err != nil {
+		return false, err
+	}
+
+	bansMutex.Lock()
+	_, found := bans[network.String()]
+	if found {
+		delete(bans, network.String())
+		err = saveLocked()
+	}
+	bansMutex.Unlock()
+
+	if found {
+		fmt.Printf("Bans > Unbanned %s\n", network)
+		events.Publish(events.Event{
+			Type: events.IPUnbanned,
+			Data: map[string]any{"network": network.String()},
+		})
+	}
+	return found, err
+}
+
+// List returns the active bans, oldest first
+func List() []Ban {
+	bansMutex.Lock()
+	defer bansMutex.Unlock()
+
+	now := time.Now()
+	list := make([]Ban, 0, len(bans))
+	pruned := false
+	for key, ban := range bans {
+		if ban.expired(now) {
+			delete(bans, key)
+			pruned = true
+			continue
+		}
+		list = append(list, *ban)
+	}
+	if pruned {
+		if err := saveLocked(); err != nil {
+			fmt.Printf("Bans > Failed to save bans: %v\n", err)
+		}
+	}
+
+	slices.SortFunc(list, func(a, b Ban) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return list
+}
+
+// Check returns the active ban covering a player IP, nil if there's none
+func Check(ip net.IP) *Ban {
+	if ip == nil {
+		return nil
+	}
+
+	bansMutex.RLock()
+	defer bansMutex.RUnlock()
+	now := time.Now()
+	for _, ban := range bans {
+		if !ban.expired(now) && ban.Matches(ip) {
+			return ban
+		}
+	}
+	return nil
+}
+
+func saveLocked() error {
+	list := make([]*Ban, 0, len(bans))
+	for _, ban := range bans {
+		list = append(list, ban)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bansFile, data, 0644)
+}
@@ -7,12 +7,142 @@ import (
 )
 
 type ClientConfig struct {
-	HTTPPort int `json:"http_port"`
+	HTTPPort        int             `json:"http_port"`
+	TunnelDownAfter int             `json:"tunnel_down_after"` // in seconds, before a route is reported as down
+	Webhooks        []WebhookConfig `json:"webhooks"`
+
+	BackendDNS BackendDNSConfig `json:"backend_dns"`
+
+	ControlAddress string `json:"control_address"` // listen address of the control channel, empty to disable
+	IPUpdateHTTP   bool   `json:"ip_update_http"`  // also accept IP updates through the HTTP API
+
+	Provisioning map[string]ProvisioningPolicy `json:"provisioning"` // server name -> routes it may create over the control channel
+
+	AutoBan AutoBanConfig `json:"auto_ban"`
 }
 
 type ServerConfig struct {
-	ClientEndpoint  string `json:"client_endpoint"`  // HTTP endpoint of tunnelled-client
+	Name            string `json:"name"`              // identifies this server in the route links of clients
+	ClientEndpoint  string `json:"client_endpoint"`   // HTTP endpoint of tunnelled-client, ignored when clients is set
+	ClientControl   string `json:"client_control"`    // control channel address of tunnelled-client, ignored when clients is set
 	IPCheckInterval int    `json:"ip_check_interval"` // in seconds
+	AdminAddress    string `json:"admin_address"`     // listen address of the admin API, empty to disable
+
+	Clients             []ClientEdgeConfig `json:"clients"`                // every tunnelled-client to notify of IP changes
+	ReconcileInterval   int                `json:"reconcile_interval"`     // in seconds, how often the client routes are checked, 0 to disable
+	IPNotifyFailedAfter int                `json:"ip_notify_failed_after"` // failed attempts in a row before a client is reported as unreachable
+
+	IPDiscovery IPDiscoveryConfig `json:"ip_discovery"`
+	PortMapping PortMappingConfig `json:"port_mapping"`
+	DDNS        []DDNSConfig      `json:"ddns"` // DNS records to point to the public IP
+
+	Webhooks []WebhookConfig `json:"webhooks"`
+
+	AutoBan AutoBanConfig `json:"auto_ban"` // bans peers sending garbage to the tunnel listeners
+}
+
+type ClientEdgeConfig struct {
+	Name     string            `json:"name"`
+	Endpoint string            `json:"endpoint"` // HTTP endpoint of the tunnelled-client, fallback when control is set
+	Control  string            `json:"control"`  // host:port of the client control channel
+	Token    string            `json:"token"`    // bearer token of the client, the .token file if empty
+	Routes   map[string]string `json:"routes"`   // server route ID -> client route ID, empty for identical IDs
+
+	Provision []ProvisionRouteConfig `json:"provision"` // routes created on the client over the control channel
+}
+
+type ProvisionRouteConfig struct {
+	RouteID     string            `json:"route_id"`     // client route ID
+	ServerRoute string            `json:"server_route"` // server route it tunnels to
+	BindIP      string            `json:"bind_ip"`
+	BindPort    int               `json:"bind_port"`
+	HAProxy     string            `json:"ha_proxy"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type ProvisioningPolicy struct {
+	// Token is the own control channel token of the server, it proves its identity. The shared .token
+	// can't be used to claim the name of a server with its own token, and servers without one can't provision.
+	Token   string   `json:"token"`
+	Ports   []string `json:"ports"`    // allowed bind ports, single ports or ranges like 25565-25570
+	BindIPs []string `json:"bind_ips"` // allowed bind addresses, any if empty
+}
+
+type IPDiscoveryConfig struct {
+	Strategy  string             `json:"strategy"` // first_success, quorum or all_agree
+	Timeout   int                `json:"timeout"`  // in seconds
+	Providers []IPProviderConfig `json:"providers"`
+}
+
+type IPProviderConfig struct {
+	Type string `json:"type"` // http, dns, interface, stun or command
+
+	URLs []string `json:"urls,omitempty"` // http
+
+	Servers []string `json:"servers,omitempty"` // stun, host:port of the STUN servers
+
+	Resolver   string `json:"resolver,omitempty"`    // dns, host:port of the server to query
+	Hostname   string `json:"hostname,omitempty"`    // dns
+	RecordType string `json:"record_type,omitempty"` // dns, A, AAAA or TXT
+
+	Interface string `json:"interface,omitempty"` // interface
+	IPv6      bool   `json:"ipv6,omitempty"`      // interface
+
+	Command []string `json:"command,omitempty"` // command
+}
+
+type PortMappingConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Method     string `json:"method"`      // auto, upnp or natpmp
+	GatewayURL string `json:"gateway_url"` // UPnP device description URL, skips SSDP discovery
+	Gateway    string `json:"gateway"`     // NAT-PMP gateway IP, the default route if empty
+	Lifetime   int    `json:"lifetime"`    // in seconds, mappings are renewed at half of it
+	IPSource   bool   `json:"ip_source"`   // also use the router's WAN address for IP discovery
+}
+
+type DDNSConfig struct {
+	Type    string   `json:"type"`    // rfc2136, cloudflare or http
+	Records []string `json:"records"` // names to update
+	TTL     int      `json:"ttl"`     // in seconds
+
+	Server       string `json:"server,omitempty"`        // rfc2136, host:port of the authoritative server
+	Zone         string `json:"zone,omitempty"`          // rfc2136
+	KeyName      string `json:"key_name,omitempty"`      // rfc2136, TSIG key, unsigned updates if empty
+	KeySecret    string `json:"key_secret,omitempty"`    // rfc2136, base64
+	KeyAlgorithm string `json:"key_algorithm,omitempty"` // rfc2136, hmac-sha256 (default), hmac-sha512 or hmac-sha1
+
+	APIToken string `json:"api_token,omitempty"` // cloudflare
+	ZoneID   string `json:"zone_id,omitempty"`   // cloudflare
+
+	URL     string            `json:"url,omitempty"`     // http, Go template receiving .IP and .Record
+	Method  string            `json:"method,omitempty"`  // http, GET if empty
+	Body    string            `json:"body,omitempty"`    // http, Go template
+	Headers map[string]string `json:"headers,omitempty"` // http, Go templates
+}
+
+type BackendDNSConfig struct {
+	Resolver string `json:"resolver"` // host:port of the DNS server, the system one if empty
+	MinTTL   int    `json:"min_ttl"`  // in seconds, also the retry delay after a failed lookup
+	MaxTTL   int    `json:"max_ttl"`  // in seconds
+}
+
+type AutoBanConfig struct {
+	Threshold int            `json:"threshold"` // score banning an IP within the window, disabled if 0
+	Window    int            `json:"window"`    // in seconds
+	BanTime   int            `json:"ban_time"`  // in seconds, how long auto bans last
+	Scores    map[string]int `json:"scores"`    // offence -> score, overriding the defaults, 0 to ignore an offence
+	Ignore    []string       `json:"ignore"`    // IPs and CIDRs never banned, like the proxies in front of us
+}
+
+type WebhookConfig struct {
+	URL      string            `json:"url"`
+	Events   []string          `json:"events"`   // event types to deliver, empty for all
+	Template string            `json:"template"` // Go template for the body, the event as JSON if empty
+	Headers  map[string]string `json:"headers"`
+	Secret   string            `json:"secret"` // HMAC-SHA256 signing secret, empty to disable signing
+
+	MaxRetries int `json:"max_retries"`
+	Timeout    int `json:"timeout"` // in seconds
 }
 
 var clientConfigFile = "config.json"
@@ -20,7 +150,17 @@ var serverConfigFile = "config.json"
 
 func LoadClientConfig() (*ClientConfig, error) {
 	config := &ClientConfig{
-		HTTPPort: 8080, // Default
+		HTTPPort:        8080, // Default
+		TunnelDownAfter: 60,
+		IPUpdateHTTP:    true,
+		BackendDNS: BackendDNSConfig{
+			MinTTL: 30,
+			MaxTTL: 3600,
+		},
+		AutoBan: AutoBanConfig{
+			Window:  60,
+			BanTime: 3600,
+		},
 	}
 
 	if _, err := os.Stat(clientConfigFile); os.IsNotExist(err) {
@@ -52,8 +192,27 @@ func SaveClientConfig(config *ClientConfig) error {
 
 func LoadServerConfig() (*ServerConfig, error) {
 	config := &ServerConfig{
+		Name:            "server",
 		ClientEndpoint:  "http://YOUR_VPS_IP:8080", // Default - needs to be configured
 		IPCheckInterval: 300,                       // 5 minutes default
+		AdminAddress:    "127.0.0.1:8081",
+
+		ReconcileInterval:   300,
+		IPNotifyFailedAfter: 5,
+		IPDiscovery: IPDiscoveryConfig{
+			Strategy: "first_success",
+			Providers: []IPProviderConfig{
+				{Type: "http", URLs: []string{"https://checkip.amazonaws.com", "https://api.ipify.org", "https://icanhazip.com"}},
+			},
+		},
+		PortMapping: PortMappingConfig{
+			Method:   "auto",
+			Lifetime: 3600,
+		},
+		AutoBan: AutoBanConfig{
+			Window:  60,
+			BanTime: 3600,
+		},
 	}
 
 	if _, err := os.Stat(serverConfigFile); os.IsNotExist(err) {
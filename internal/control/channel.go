@@ -0,0 +1,236 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	minRedialDelay = time.Second
+	maxRedialDelay = 30 * time.Second
+)
+
+// ErrNotConnected is returned by requests sent while the channel is down
+var ErrNotConnected = errors.New("control channel not connected")
+
+// ChannelStatus is the state of a control channel, exposed in the server status
+type ChannelStatus struct {
+	Address     string    `json:"address"`
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connected_at,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Channel is the persistent control connection from tunnelled-server to a tunnelled-client.
+// It is redialed as soon as it drops, e.g. right after the public IP changed.
+type Channel struct {
+	address    string
+	serverName string
+	token      string
+
+	// OnConnect is called (in its own goroutine) every time the channel is established
+	OnConnect func()
+
+	stateMutex  sync.Mutex
+	wire        *wire
+	pending     map[uint64]chan Message
+	nextID      uint64
+	connectedAt time.Time
+	lastError   string
+}
+
+func NewChannel(address, serverName, token string) *Channel {
+	return &Channel{
+		address:    address,
+		serverName: serverName,
+		token:      token,
+		pending:    make(map[uint64]chan Message),
+	}
+}
+
+// Run keeps the channel connected, it never returns
+func (c *Channel) Run() {
+	delay := minRedialDelay
+	for {
+		err := c.connect()
+		if err == nil {
+			delay = minRedialDelay
+			err = c.readLoop()
+		}
+
+		c.disconnect(err)
+		fmt.Printf("Control > Channel to %s down, redialing in %v: %v\n", c.address, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, maxRedialDelay)
+	}
+}
+
+func (c *Channel) connect() error {
+	conn, err := net.DialTimeout("tcp", c.address, handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	w := newWire(conn)
+
+	var challenge challengePayload
+	err = w.receiveType(TypeChallenge, &challenge)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+
+	nonce := newNonce()
+	err = w.sendPayload(TypeAuth, 0, authPayload{
+		Server: c.serverName,
+		Nonce:  nonce,
+		MAC:    sign(c.token, "server", challenge.Nonce),
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	var welcome welcomePayload
+	err = w.receiveType(TypeWelcome, &welcome)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+	if !verify(c.token, "client", nonce, welcome.MAC) {
+		conn.Close()
+		return errors.New("client failed to authenticate")
+	}
+	w.secure(c.token, challenge.Nonce, nonce, "server")
+
+	c.stateMutex.Lock()
+	c.wire = w
+	c.connectedAt = time.Now()
+	c.lastError = ""
+	c.stateMutex.Unlock()
+
+	fmt.Printf("Control > Channel to %s established\n", c.address)
+	if c.OnConnect != nil {
+		go c.OnConnect()
+	}
+	return nil
+}
+
+func (c *Channel) readLoop() error {
+	c.stateMutex.Lock()
+	w := c.wire
+	c.stateMutex.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go w.heartbeat(done)
+
+	for {
+		msg, err := w.receive(heartbeatTimeout)
+		if err != nil {
+			return err
+		}
+		if msg.Type != TypeReply {
+			continue
+		}
+
+		c.stateMutex.Lock()
+		reply, ok := c.pending[msg.ID]
+		delete(c.pending, msg.ID)
+		c.stateMutex.Unlock()
+		if ok {
+			reply <- msg
+		}
+	}
+}
+
+// disconnect closes the connection and fails every pending request
+func (c *Channel) disconnect(err error) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if c.wire != nil {
+		c.wire.conn.Close()
+		c.wire = nil
+	}
+	c.lastError = err.Error()
+	for id, reply := range c.pending {
+		reply <- Message{Type: TypeReply, ID: id, Error: ErrNotConnected.Error()}
+		delete(c.pending, id)
+	}
+}
+
+// Connected reports whether the channel is up
+func (c *Channel) Connected() bool {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.wire != nil
+}
+
+func (c *Channel) Status() ChannelStatus {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	status := ChannelStatus{
+		Address:   c.address,
+		Connected: c.wire != nil,
+		LastError: c.lastError,
+	}
+	if status.Connected {
+		status.ConnectedAt = c.connectedAt
+	}
+	return status
+}
+
+// Request sends a request to the client and decodes its reply into result (if not nil)
+func (c *Channel) Request(ctx context.Context, msgType MessageType, payload any, result any) error {
+	raw, err := c.RequestRaw(ctx, msgType, payload)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// RequestRaw sends a request to the client and returns the payload of its reply
+func (c *Channel) RequestRaw(ctx context.Context, msgType MessageType, payload any) (json.RawMessage, error) {
+	c.stateMutex.Lock()
+	w := c.wire
+	if w == nil {
+		c.stateMutex.Unlock()
+		return nil, ErrNotConnected
+	}
+	c.nextID++
+	id := c.nextID
+	reply := make(chan Message, 1)
+	c.pending[id] = reply
+	c.stateMutex.Unlock()
+
+	err := w.sendPayload(msgType, id, payload)
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Error != "" {
+			return nil, errors.New(msg.Error)
+		}
+		return msg.Payload, nil
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Channel) forget(id uint64) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	delete(c.pending, id)
+}
@@ -0,0 +1,219 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// HandlerFunc answers a request sent by the server named server, the result is sent back as the reply payload
+type HandlerFunc func(server string, payload json.RawMessage) (any, error)
+
+// SessionInfo describes a connected server, exposed in the client status
+type SessionInfo struct {
+	Server      string    `json:"server"`
+	Address     string    `json:"address"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// Listener accepts control connections from tunnelled-servers on the client
+type Listener struct {
+	address     string
+	token       string            // shared token
+	credentials map[string]string // server name -> its own token
+
+	handlers      map[MessageType]HandlerFunc
+	handlersMutex sync.RWMutex
+
+	sessions sync.Map // *session -> struct{}
+}
+
+type session struct {
+	info      SessionInfo
+	infoMutex sync.Mutex
+}
+
+// NewListener creates a listener accepting the shared token and the own tokens of the servers in credentials
+func NewListener(address, token string, credentials map[string]string) *Listener {
+	return &Listener{
+		address:     address,
+		token:       token,
+		credentials: credentials,
+		handlers:    make(map[MessageType]HandlerFunc),
+	}
+}
+
+// Handle registers the handler of a request type
+func (l *Listener) Handle(msgType MessageType, handler HandlerFunc) {
+	l.handlersMutex.Lock()
+	defer l.handlersMutex.Unlock()
+	l.handlers[msgType] = handler
+}
+
+// Sessions returns the connected servers
+func (l *Listener) Sessions() []SessionInfo {
+	sessions := make([]SessionInfo, 0)
+	l.sessions.Range(func(key, value any) bool {
+		s := key.(*session)
+		s.infoMutex.Lock()
+		sessions = append(sessions, s.info)
+		s.infoMutex.Unlock()
+		return true
+	})
+	return sessions
+}
+
+// Serve accepts control connections until the listener fails
+func (l *Listener) Serve() error {
+	listener, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", l.address, err)
+	}
+	fmt.Printf("Control > Listening on %s\n", l.address)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go l.serveConn(conn)
+	}
+}
+
+func (l *Listener) serveConn(conn net.Conn) {
+	defer conn.Close()
+	w := newWire(conn)
+
+	server, err := l.handshake(w)
+	if err != nil {
+		fmt.Printf("Control > Rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	s := &session{info: SessionInfo{
+		Server:      server,
+		Address:     conn.RemoteAddr().String(),
+		ConnectedAt: time.Now(),
+		LastSeen:    time.Now(),
+	}}
+	l.sessions.Store(s, struct{}{})
+	defer l.sessions.Delete(s)
+	fmt.Printf("Control > Server %s connected from %s\n", server, conn.RemoteAddr())
+
+	done := make(chan struct{})
+	defer close(done)
+	go w.heartbeat(done)
+
+	for {
+		msg, err := w.receive(heartbeatTimeout)
+		if err != nil {
+			fmt.Printf("Control > Server %s disconnected: %v\n", server, err)
+			return
+		}
+
+		s.infoMutex.Lock()
+		s.info.LastSeen = time.Now()
+		s.infoMutex.Unlock()
+
+		if msg.Type == TypeHeartbeat {
+			continue
+		}
+		// Changes are applied in the order the server sent them, an older IP or route sync must never win.
+		// Only reads run in the background.
+		if isRead(msg) {
+			go l.dispatch(w, server, msg)
+		} else {
+			l.dispatch(w, server, msg)
+		}
+	}
+}
+
+// isRead reports whether a request doesn't change anything on the client, it may then run concurrently
+func isRead(msg Message) bool {
+	switch msg.Type {
+	case TypeRouteState:
+		return true
+	case TypeAdmin:
+		var command AdminCommand
+		return json.Unmarshal(msg.Payload, &command) == nil && command.Command != "kick"
+	}
+	return false
+}
+
+// handshake authenticates the server and proves our own knowledge of its token, it returns the server name
+func (l *Listener) handshake(w *wire) (string, error) {
+	nonce := newNonce()
+	err := w.sendPayload(TypeChallenge, 0, challengePayload{Nonce: nonce})
+	if err != nil {
+		return "", err
+	}
+
+	var auth authPayload
+	err = w.receiveType(TypeAuth, &auth)
+	if err != nil {
+		return "", err
+	}
+	server, token, err := l.authenticate(nonce, auth)
+	if err != nil {
+		_ = w.send(Message{Type: TypeReply, Error: "authentication failed"})
+		return "", err
+	}
+	if auth.Nonce == "" {
+		return "", fmt.Errorf("server %s sent no challenge", server)
+	}
+
+	err = w.sendPayload(TypeWelcome, 0, welcomePayload{MAC: sign(token, "client", auth.Nonce)})
+	if err != nil {
+		return "", err
+	}
+	w.secure(token, nonce, auth.Nonce, "client")
+	return server, nil
+}
+
+// authenticate finds the token the server signed our nonce with. A server's own token decides its name,
+// whatever it declared. The shared token is only accepted for the names without their own token.
+func (l *Listener) authenticate(nonce string, auth authPayload) (string, string, error) {
+	for server, token := range l.credentials {
+		if token != "" && verify(token, "server", nonce, auth.MAC) {
+			if auth.Server != server {
+				fmt.Printf("Control > Server declaring itself as %s authenticated as %s\n", auth.Server, server)
+			}
+			return server, token, nil
+		}
+	}
+
+	if !verify(l.token, "server", nonce, auth.MAC) {
+		return "", "", fmt.Errorf("invalid token from server %s", auth.Server)
+	}
+	if token, ok := l.credentials[auth.Server]; ok && token != "" {
+		return "", "", fmt.Errorf("server %s has its own token, the shared token can't be used for it", auth.Server)
+	}
+	return auth.Server, l.token, nil
+}
+
+func (l *Listener) dispatch(w *wire, server string, msg Message) {
+	l.handlersMutex.RLock()
+	handler, ok := l.handlers[msg.Type]
+	l.handlersMutex.RUnlock()
+
+	reply := Message{Type: TypeReply, ID: msg.ID}
+	if !ok {
+		reply.Error = fmt.Sprintf("unsupported message type %s", msg.Type)
+	} else if result, err := handler(server, msg.Payload); err != nil {
+		reply.Error = err.Error()
+	} else if reply.Payload, err = json.Marshal(result); err != nil {
+		reply.Error = fmt.Sprintf("failed to encode reply: %v", err)
+	}
+
+	if msg.ID == 0 {
+		// nobody waits for it
+		return
+	}
+	err := w.send(reply)
+	if err != nil {
+		fmt.Printf("Control > Failed to reply to server %s: %v\n", server, err)
+	}
+}
@@ -0,0 +1,237 @@
+package control
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The control protocol is one JSON message per line over a TCP connection opened by tunnelled-server.
+// Both sides prove they know the token by signing a nonce sent by the other side:
+//
+//	client -> server  challenge {nonce}
+//	server -> client  auth      {server, nonce, mac}
+//	client -> server  welcome   {mac}
+//
+// Afterwards the server sends requests (with an ID) and the client answers them with a reply of the same ID.
+// Every message after the handshake carries a sequence number, counted separately in each direction, and
+// an HMAC with a session key derived from the token and both nonces. A message with a wrong MAC or
+// out of sequence closes the connection, so nothing can be injected, replayed, reordered or dropped.
+// Both sides send heartbeats, a connection silent for longer than heartbeatTimeout is closed.
+type MessageType string
+
+const (
+	TypeChallenge MessageType = "challenge"
+	TypeAuth      MessageType = "auth"
+	TypeWelcome   MessageType = "welcome"
+	TypeHeartbeat MessageType = "heartbeat"
+	TypeReply     MessageType = "reply"
+
+	TypeIPChange   MessageType = "ip_change"   // IPUpdateRequest -> IPUpdateResponse
+	TypeRouteState MessageType = "route_state" // nothing -> RouteStateResponse
+	TypeRouteSync  MessageType = "route_sync"  // SyncRequest -> SyncResponse, routes provisioned by the server
+	TypeAdmin      MessageType = "admin"       // AdminCommand -> command specific result
+)
+
+const (
+	heartbeatInterval = 15 * time.Second
+	heartbeatTimeout  = 45 * time.Second
+	handshakeTimeout  = 10 * time.Second
+	maxMessageSize    = 1 << 20
+)
+
+type Message struct {
+	Type    MessageType     `json:"type"`
+	ID      uint64          `json:"id,omitempty"` // set on requests, echoed in their reply
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   string          `json:"error,omitempty"` // replies only
+
+	// Authentication once the handshake is done, see wire.secure
+	Seq uint64 `json:"seq,omitempty"`
+	MAC string `json:"mac,omitempty"`
+}
+
+// AdminCommand is the payload of admin messages
+type AdminCommand struct {
+	Command      string `json:"command"` // status, connections, metrics, kick or reachability
+	ConnectionID string `json:"connection_id,omitempty"`
+	RouteID      string `json:"route_id,omitempty"` // reachability, every route if empty
+	Reason       string `json:"reason,omitempty"`
+}
+
+type challengePayload struct {
+	Nonce string `json:"nonce"`
+}
+
+type authPayload struct {
+	Server string `json:"server"`
+	Nonce  string `json:"nonce"` // the server's challenge to the client
+	MAC    string `json:"mac"`
+}
+
+type welcomePayload struct {
+	MAC string `json:"mac"`
+}
+
+// wire reads and writes messages on a connection, writes are safe for concurrent use
+type wire struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+
+	writeMutex sync.Mutex
+
+	// Message authentication, set by secure once the handshake is done. The send sequence is guarded by writeMutex,
+	// the receive one is only used by the reading goroutine.
+	key         []byte
+	sendRole    string
+	receiveRole string
+	sendSeq     uint64
+	receiveSeq  uint64
+}
+
+func newWire(conn net.Conn) *wire {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxMessageSize)
+	return &wire{conn: conn, scanner: scanner}
+}
+
+// secure authenticates every following message with a key derived from the token and the nonces of the handshake,
+// role is the side of this end (client or server)
+func (w *wire) secure(token, clientNonce, serverNonce, role string) {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("session:" + clientNonce + ":" + serverNonce))
+	w.key = mac.Sum(nil)
+	w.sendRole = role
+	w.receiveRole = "client"
+	if role == "client" {
+		w.receiveRole = "server"
+	}
+}
+
+// messageMAC signs a message sent by role
+func (w *wire) messageMAC(role string, msg Message) string {
+	mac := hmac.New(sha256.New, w.key)
+	fmt.Fprintf(mac, "%s\n%d\n%s\n%d\n%q\n", role, msg.Seq, msg.Type, msg.ID, msg.Error)
+	mac.Write(msg.Payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *wire) send(msg Message) error {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+
+	if w.key != nil {
+		if len(msg.Payload) > 0 {
+			// Signed the way it's encoded on the wire, which is how the other side reads it
+			payload, err := json.Marshal(msg.Payload)
+			if err != nil {
+				return err
+			}
+			msg.Payload = payload
+		}
+		w.sendSeq++
+		msg.Seq = w.sendSeq
+		msg.MAC = w.messageMAC(w.sendRole, msg)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_ = w.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	_, err = w.conn.Write(append(data, '\n'))
+	return err
+}
+
+// sendPayload sends a message with the JSON encoding of payload
+func (w *wire) sendPayload(msgType MessageType, id uint64, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return w.send(Message{Type: msgType, ID: id, Payload: data})
+}
+
+// receive reads the next message, failing if none arrives before timeout
+func (w *wire) receive(timeout time.Duration) (Message, error) {
+	_ = w.conn.SetReadDeadline(time.Now().Add(timeout))
+	if !w.scanner.Scan() {
+		if err := w.scanner.Err(); err != nil {
+			return Message{}, err
+		}
+		return Message{}, errors.New("connection closed")
+	}
+
+	var msg Message
+	err := json.Unmarshal(w.scanner.Bytes(), &msg)
+	if err != nil {
+		return Message{}, fmt.Errorf("invalid message: %v", err)
+	}
+
+	if w.key != nil {
+		if !hmac.Equal([]byte(msg.MAC), []byte(w.messageMAC(w.receiveRole, msg))) {
+			return Message{}, fmt.Errorf("invalid MAC on %s message", msg.Type)
+		}
+		if msg.Seq != w.receiveSeq+1 {
+			return Message{}, fmt.Errorf("%s message out of sequence (%d after %d)", msg.Type, msg.Seq, w.receiveSeq)
+		}
+		w.receiveSeq = msg.Seq
+	}
+	return msg, nil
+}
+
+// receiveType reads the next message and decodes its payload, it must be of the expected type
+func (w *wire) receiveType(msgType MessageType, payload any) error {
+	msg, err := w.receive(handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	if msg.Type != msgType {
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		return fmt.Errorf("expected %s message, got %s", msgType, msg.Type)
+	}
+	return json.Unmarshal(msg.Payload, payload)
+}
+
+// heartbeat sends heartbeats until done is closed or a write fails
+func (w *wire) heartbeat(done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := w.send(Message{Type: TypeHeartbeat}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func newNonce() string {
+	nonce := make([]byte, 32)
+	_, _ = rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// sign proves the knowledge of token for a nonce, role keeps a signature from being replayed by the other side
+func sign(token, role, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(role + ":" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(token, role, nonce, signature string) bool {
+	return hmac.Equal([]byte(sign(token, role, nonce)), []byte(signature))
+}
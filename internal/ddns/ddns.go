@@ -0,0 +1,153 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/events"
+)
+
+const (
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 10 * time.Minute
+)
+
+// Status is the state of an updater, exposed in the server status
+type Status struct {
+	Name                string    `json:"name"`
+	DesiredIP           string    `json:"desired_ip"`
+	Updated             bool      `json:"updated"`
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+// Service pushes IP changes to every configured DNS updater, retrying until they succeed
+type Service struct {
+	workers []*worker
+}
+
+type worker struct {
+	updater Updater
+
+	stateMutex sync.Mutex
+	status     Status
+	wake       chan struct{}
+}
+
+func NewService(configs []config.DDNSConfig) (*Service, error) {
+	s := &Service{}
+	for i, cfg := range configs {
+		updater, err := NewUpdater(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("DDNS updater #%d: %v", i+1, err)
+		}
+		s.workers = append(s.workers, &worker{
+			updater: updater,
+			status:  Status{Name: updater.Name()},
+			wake:    make(chan struct{}, 1),
+		})
+	}
+	return s, nil
+}
+
+// Start runs the update loop of every updater
+func (s *Service) Start() {
+	for _, w := range s.workers {
+		go w.run()
+	}
+}
+
+// SetIP schedules the update of every record to a new IP, it returns immediately
+func (s *Service) SetIP(ip string) {
+	for _, w := range s.workers {
+		w.stateMutex.Lock()
+		w.status.DesiredIP = ip
+		w.status.Updated = false
+		w.stateMutex.Unlock()
+
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Service) Status() []Status {
+	status := make([]Status, 0, len(s.workers))
+	for _, w := range s.workers {
+		w.stateMutex.Lock()
+		status = append(status, w.status)
+		w.stateMutex.Unlock()
+	}
+	return status
+}
+
+func (w *worker) run() {
+	retryDelay := minRetryDelay
+	for {
+		w.stateMutex.Lock()
+		ip, pending := w.status.DesiredIP, !w.status.Updated && w.status.DesiredIP != ""
+		w.stateMutex.Unlock()
+
+		if !pending {
+			<-w.wake
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := w.updater.Update(ctx, ip)
+		cancel()
+
+		if w.record(ip, err) {
+			fmt.Printf("DDNS > Updated %s to %s\n", w.updater.Name(), ip)
+			retryDelay = minRetryDelay
+			continue
+		}
+
+		fmt.Printf("DDNS > Failed to update %s to %s, retrying in %v: %v\n", w.updater.Name(), ip, retryDelay, err)
+		select {
+		case <-time.After(retryDelay):
+		case <-w.wake:
+		}
+		retryDelay = min(retryDelay*2, maxRetryDelay)
+	}
+}
+
+// record stores the result of an update attempt and reports whether it succeeded
+func (w *worker) record(ip string, err error) bool {
+	w.stateMutex.Lock()
+	defer w.stateMutex.Unlock()
+
+	w.status.LastAttempt = time.Now()
+	if err == nil {
+		// A newer IP may have been set while we were updating
+		if w.status.DesiredIP == ip {
+			w.status.Updated = true
+		}
+		w.status.LastSuccess = w.status.LastAttempt
+		w.status.LastError = ""
+		w.status.ConsecutiveFailures = 0
+		events.Publish(events.Event{
+			Type: events.DDNSUpdated,
+			Data: map[string]any{"updater": w.updater.Name(), "ip": ip},
+		})
+		return true
+	}
+
+	w.status.LastError = err.Error()
+	w.status.ConsecutiveFailures++
+	events.Publish(events.Event{
+		Type: events.DDNSUpdateFailed,
+		Data: map[string]any{
+			"updater":              w.updater.Name(),
+			"ip":                   ip,
+			"error":                err.Error(),
+			"consecutive_failures": w.status.ConsecutiveFailures,
+		},
+	})
+	return false
+}
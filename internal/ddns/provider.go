@@ -0,0 +1,298 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/dns"
+)
+
+// Updater points DNS records to a new IP
+type Updater interface {
+	Name() string
+	Update(ctx context.Context, ip string) error
+}
+
+// NewUpdater creates the updater described by the config
+func NewUpdater(cfg config.DDNSConfig) (Updater, error) {
+	if len(cfg.Records) == 0 {
+		return nil, fmt.Errorf("%s updater has no records", cfg.Type)
+	}
+
+	switch cfg.Type {
+	case "rfc2136":
+		if cfg.Server == "" || cfg.Zone == "" {
+			return nil, errors.New("rfc2136 updater needs a server and a zone")
+		}
+		updater := &RFC2136Updater{Server: cfg.Server, Zone: cfg.Zone, Records: cfg.Records, TTL: uint32(cfg.TTL)}
+		if cfg.KeyName != "" {
+			updater.Key = &dns.TSIGKey{Name: cfg.KeyName, Secret: cfg.KeySecret, Algorithm: cfg.KeyAlgorithm}
+		}
+		return updater, nil
+	case "cloudflare":
+		if cfg.APIToken == "" || cfg.ZoneID == "" {
+			return nil, errors.New("cloudflare updater needs an api_token and a zone_id")
+		}
+		return &CloudflareUpdater{
+			APIToken: cfg.APIToken,
+			ZoneID:   cfg.ZoneID,
+			Records:  cfg.Records,
+			TTL:      cfg.TTL,
+			BaseURL:  "https://api.cloudflare.com/client/v4",
+		}, nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, errors.New("http updater needs a url")
+		}
+		return NewHTTPUpdater(cfg)
+	default:
+		return nil, fmt.Errorf("unknown DDNS updater type %s", cfg.Type)
+	}
+}
+
+// RFC2136Updater sends dynamic updates to an authoritative DNS server, optionally signed with TSIG
+type RFC2136Updater struct {
+	Server  string // host:port, port 53 if omitted
+	Zone    string
+	Records []string
+	TTL     uint32
+	Key     *dns.TSIGKey
+}
+
+func (u *RFC2136Updater) Name() string {
+	return "rfc2136:" + u.Server
+}
+
+func (u *RFC2136Updater) Update(ctx context.Context, ip string) error {
+	return dns.Update(ctx, u.Server, u.Zone, u.Records, ip, u.TTL, u.Key)
+}
+
+// CloudflareUpdater updates existing records through the Cloudflare API
+type CloudflareUpdater struct {
+	APIToken string
+	ZoneID   string
+	Records  []string
+	TTL      int // 1 means automatic
+	BaseURL  string
+}
+
+func (u *CloudflareUpdater) Name() string {
+	return "cloudflare:" + u.ZoneID
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (u *CloudflareUpdater) Update(ctx context.Context, ip string) error {
+	recordType := "A"
+	if net.ParseIP(ip).To4() == nil {
+		recordType = "AAAA"
+	}
+
+	var errs []error
+	for _, name := range u.Records {
+		errs = append(errs, u.updateRecord(ctx, name, recordType, ip))
+	}
+	return errors.Join(errs...)
+}
+
+func (u *CloudflareUpdater) updateRecord(ctx context.Context, name, recordType, ip string) error {
+	query := url.Values{"type": {recordType}, "name": {name}}
+	result, err := u.call(ctx, http.MethodGet, "/zones/"+u.ZoneID+"/dns_records?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %v", name, err)
+	}
+
+	var records []struct {
+		ID      string `json:"id"`
+		Content string `json:"content"`
+	}
+	err = json.Unmarshal(result, &records)
+	if err != nil {
+		return fmt.Errorf("invalid records of %s: %v", name, err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no %s record named %s", recordType, name)
+	}
+
+	body := map[string]any{"content": ip}
+	if u.TTL > 0 {
+		body["ttl"] = u.TTL
+	}
+	for _, record := range records {
+		if record.Content == ip {
+			continue
+		}
+		_, err = u.call(ctx, http.MethodPatch, "/zones/"+u.ZoneID+"/dns_records/"+record.ID, body)
+		if err != nil {
+			return fmt.Errorf("failed to update %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (u *CloudflareUpdater) call(ctx context.Context, method, path string, body any) (json.RawMessage, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+u.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var cfResp cloudflareResponse
+	err = json.NewDecoder(resp.Body).Decode(&cfResp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response (status %d): %v", resp.StatusCode, err)
+	}
+	if !cfResp.Success {
+		var messages []string
+		for _, e := range cfResp.Errors {
+			messages = append(messages, e.Message)
+		}
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.Join(messages, ", "))
+	}
+	return cfResp.Result, nil
+}
+
+// HTTPUpdater calls a templated URL once per record, for dyndns2-style update APIs.
+// The URL, body and headers are Go templates receiving .IP and .Record.
+type HTTPUpdater struct {
+	Method  string
+	Records []string
+
+	url     *template.Template
+	body    *template.Template
+	headers map[string]*template.Template
+}
+
+type httpTemplateData struct {
+	IP     string
+	Record string
+}
+
+func NewHTTPUpdater(cfg config.DDNSConfig) (*HTTPUpdater, error) {
+	u := &HTTPUpdater{
+		Method:  cfg.Method,
+		Records: cfg.Records,
+		headers: make(map[string]*template.Template),
+	}
+	if u.Method == "" {
+		u.Method = http.MethodGet
+	}
+
+	var err error
+	u.url, err = template.New("url").Funcs(template.FuncMap{"query": url.QueryEscape}).Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url template: %v", err)
+	}
+	if cfg.Body != "" {
+		u.body, err = template.New("body").Parse(cfg.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body template: %v", err)
+		}
+	}
+	for name, value := range cfg.Headers {
+		u.headers[name], err = template.New(name).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of header %s: %v", name, err)
+		}
+	}
+	return u, nil
+}
+
+func (u *HTTPUpdater) Name() string {
+	return "http"
+}
+
+func (u *HTTPUpdater) Update(ctx context.Context, ip string) error {
+	var errs []error
+	for _, record := range u.Records {
+		err := u.updateRecord(ctx, httpTemplateData{IP: ip, Record: record})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update %s: %v", record, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (u *HTTPUpdater) updateRecord(ctx context.Context, data httpTemplateData) error {
+	var target bytes.Buffer
+	err := u.url.Execute(&target, data)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if u.body != nil {
+		var buf bytes.Buffer
+		err = u.body.Execute(&buf, data)
+		if err != nil {
+			return err
+		}
+		body = &buf
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, u.Method, target.String(), body)
+	if err != nil {
+		return err
+	}
+	for name, tmpl := range u.headers {
+		var value bytes.Buffer
+		err = tmpl.Execute(&value, data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(name, value.String())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	// dyndns2 servers answer 200 with an error code in the body
+	answer := strings.TrimSpace(string(respBody))
+	for _, code := range []string{"badauth", "nohost", "notfqdn", "abuse", "badagent", "dnserr", "911"} {
+		if strings.HasPrefix(answer, code) {
+			return fmt.Errorf("update refused: %s", answer)
+		}
+	}
+	return nil
+}
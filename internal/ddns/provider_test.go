@@ -0,0 +1,302 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tunnelled/internal/config"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	testKeyName = "tunnelled-key."
+	testZone    = "example.com."
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// fakeAuthority is an authoritative server for testZone accepting RFC 2136 updates over TCP,
+// signed with the hmac-sha256 TSIG key testKeyName when a secret is set
+type fakeAuthority struct {
+	listener net.Listener
+	secret   []byte
+
+	mutex   sync.Mutex
+	records map[string][]string // name -> addresses
+	ttls    map[string]uint32
+}
+
+func newFakeAuthority(t *testing.T, secret []byte) *fakeAuthority {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	authority := &fakeAuthority{
+		listener: listener,
+		secret:   secret,
+		records:  map[string][]string{"home.example.com.": {"192.0.2.1"}},
+		ttls:     make(map[string]uint32),
+	}
+	go authority.serve()
+	return authority
+}
+
+func (a *fakeAuthority) serve() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *fakeAuthority) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return
+	}
+
+	id, rcode := a.update(msg)
+	resp := dnsmessage.Message{Header: dnsmessage.Header{ID: id, Response: true, OpCode: 5, RCode: rcode}}
+	packed, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+}
+
+// update applies a dynamic update, returning its ID and the response code
+func (a *fakeAuthority) update(msg []byte) (uint16, dnsmessage.RCode) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return 0, dnsmessage.RCodeFormatError
+	}
+	if header.OpCode != 5 {
+		return header.ID, dnsmessage.RCodeNotImplemented
+	}
+
+	questions, err := parser.AllQuestions()
+	if err != nil || len(questions) != 1 || questions[0].Type != dnsmessage.TypeSOA {
+		return header.ID, dnsmessage.RCodeFormatError
+	}
+	if !strings.EqualFold(questions[0].Name.String(), testZone) {
+		return header.ID, 10 // NOTZONE
+	}
+	if err := parser.SkipAllAnswers(); err != nil { // prerequisites
+		return header.ID, dnsmessage.RCodeFormatError
+	}
+
+	type change struct {
+		name   string
+		delete bool
+		ip     string
+		ttl    uint32
+	}
+	var changes []change
+	for {
+		rr, err := parser.AuthorityHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil || rr.Type != dnsmessage.TypeA {
+			return header.ID, dnsmessage.RCodeFormatError
+		}
+		name := strings.ToLower(rr.Name.String())
+		if !strings.HasSuffix(name, "."+testZone) {
+			return header.ID, 10 // NOTZONE
+		}
+
+		switch rr.Class {
+		case 255: // ANY, deletes the RRset and has no data
+			if rr.Length != 0 || rr.TTL != 0 {
+				return header.ID, dnsmessage.RCodeFormatError
+			}
+			if err := parser.SkipAuthority(); err != nil {
+				return header.ID, dnsmessage.RCodeFormatError
+			}
+			changes = append(changes, change{name: name, delete: true})
+		case dnsmessage.ClassINET:
+			body, err := parser.AResource()
+			if err != nil {
+				return header.ID, dnsmessage.RCodeFormatError
+			}
+			changes = append(changes, change{name: name, ip: net.IP(body.A[:]).String(), ttl: rr.TTL})
+		default:
+			return header.ID, dnsmessage.RCodeFormatError
+		}
+	}
+
+	if a.secret != nil {
+		if err := verifyTSIG(msg, parser, a.secret); err != nil {
+			return header.ID, 9 // NOTAUTH
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, c := range changes {
+		if c.delete {
+			delete(a.records, c.name)
+			continue
+		}
+		a.records[c.name] = append(a.records[c.name], c.ip)
+		a.ttls[c.name] = c.ttl
+	}
+	return header.ID, dnsmessage.RCodeSuccess
+}
+
+// verifyTSIG checks the hmac-sha256 TSIG record ending msg (RFC 8945 section 4.6), the parser
+// must be at the start of the additional section
+func verifyTSIG(msg []byte, parser dnsmessage.Parser, secret []byte) error {
+	resources, err := parser.AllAdditionals()
+	if err != nil || len(resources) == 0 {
+		return errors.New("no TSIG record")
+	}
+	tsig := resources[len(resources)-1]
+	if tsig.Header.Type != 250 || tsig.Header.Class != 255 || !strings.EqualFold(tsig.Header.Name.String(), testKeyName) {
+		return errors.New("the last additional record is not a TSIG of the key")
+	}
+	rdata := tsig.Body.(*dnsmessage.UnknownResource).Data
+
+	algorithm := wireName("hmac-sha256.")
+	if !bytes.HasPrefix(rdata, algorithm) {
+		return errors.New("not signed with hmac-sha256")
+	}
+	fields := rdata[len(algorithm):]
+	if len(fields) < 10 {
+		return errors.New("truncated TSIG")
+	}
+	timeSigned := fields[:6]
+	fudge := binary.BigEndian.Uint16(fields[6:8])
+	macSize := int(binary.BigEndian.Uint16(fields[8:10]))
+	if len(fields) < 10+macSize+6 {
+		return errors.New("truncated TSIG")
+	}
+	mac := fields[10 : 10+macSize]
+	errorAndOther := fields[10+macSize+2:]
+
+	signedAt := int64(binary.BigEndian.Uint16(timeSigned))<<32 | int64(binary.BigEndian.Uint32(timeSigned[2:]))
+	if skew := time.Since(time.Unix(signedAt, 0)); skew > time.Duration(fudge)*time.Second || skew < -time.Duration(fudge)*time.Second {
+		return fmt.Errorf("signed %v away from now", skew)
+	}
+
+	// The MAC covers the message without its TSIG record, with the additional count it had before signing
+	keyName := wireName(testKeyName)
+	tsigLength := len(keyName) + 10 + len(rdata)
+	unsigned := append([]byte{}, msg[:len(msg)-tsigLength]...)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+
+	h := hmac.New(sha256.New, secret)
+	h.Write(unsigned)
+	h.Write(keyName)
+	h.Write([]byte{0, 255, 0, 0, 0, 0}) // class ANY, TTL 0
+	h.Write(algorithm)
+	h.Write(timeSigned)
+	h.Write(fields[6:8])
+	h.Write(errorAndOther)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func wireName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+func (a *fakeAuthority) lookup(name string) ([]string, uint32) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.records[name], a.ttls[name]
+}
+
+func newRFC2136Updater(t *testing.T, authority *fakeAuthority, secret []byte) Updater {
+	cfg := config.DDNSConfig{
+		Type:    "rfc2136",
+		Records: []string{"home.example.com", "mc.example.com"},
+		TTL:     60,
+		Server:  authority.listener.Addr().String(),
+		Zone:    "example.com",
+	}
+	if secret != nil {
+		cfg.KeyName = strings.TrimSuffix(testKeyName, ".")
+		cfg.KeySecret = base64.StdEncoding.EncodeToString(secret)
+	}
+	updater, err := NewUpdater(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return updater
+}
+
+func TestRFC2136SignedUpdate(t *testing.T) {
+	authority := newFakeAuthority(t, testSecret)
+	updater := newRFC2136Updater(t, authority, testSecret)
+
+	for _, ip := range []string{"203.0.113.9", "203.0.113.10"} {
+		err := updater.Update(context.Background(), ip)
+		if err != nil {
+			t.Fatalf("update to %s: %v", ip, err)
+		}
+		// The RRsets are replaced, the previous addresses are gone
+		for _, name := range []string{"home.example.com.", "mc.example.com."} {
+			records, ttl := authority.lookup(name)
+			if len(records) != 1 || records[0] != ip || ttl != 60 {
+				t.Errorf("%s is %v (TTL %d) after the update to %s", name, records, ttl, ip)
+			}
+		}
+	}
+}
+
+func TestRFC2136RejectedSignature(t *testing.T) {
+	authority := newFakeAuthority(t, testSecret)
+
+	for name, secret := range map[string][]byte{"wrong key": []byte("not the secret of the zone"), "unsigned": nil} {
+		err := newRFC2136Updater(t, authority, secret).Update(context.Background(), "203.0.113.9")
+		if err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+			t.Errorf("%s update: expected a NOTAUTH refusal, got %v", name, err)
+		}
+	}
+	if records, _ := authority.lookup("home.example.com."); len(records) != 1 || records[0] != "192.0.2.1" {
+		t.Errorf("refused updates changed the zone: %v", records)
+	}
+}
+
+func TestRFC2136UnsignedUpdate(t *testing.T) {
+	authority := newFakeAuthority(t, nil)
+
+	err := newRFC2136Updater(t, authority, nil).Update(context.Background(), "198.51.100.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := authority.lookup("mc.example.com."); len(records) != 1 || records[0] != "198.51.100.4" {
+		t.Errorf("mc.example.com. is %v", records)
+	}
+}
@@ -0,0 +1,206 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxUDPSize = 1232
+
+// SystemServer returns the first nameserver of /etc/resolv.conf, or the local one if there is none
+func SystemServer() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// normalizeServer adds the default DNS port to a server address without one
+func normalizeServer(server string) string {
+	if server == "" {
+		return SystemServer()
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+// LookupIP resolves the addresses of a hostname with the given server (the system one if empty).
+// A records are preferred, AAAA records are only queried when there are none.
+// It also returns the lowest TTL of the answers.
+func LookupIP(ctx context.Context, server, hostname string) ([]string, time.Duration, error) {
+	ips, ttl, err := lookup(ctx, server, hostname, dnsmessage.TypeA)
+	if err != nil || len(ips) > 0 {
+		return ips, ttl, err
+	}
+
+	ips, ttl, err = lookup(ctx, server, hostname, dnsmessage.TypeAAAA)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no A or AAAA records for %s", hostname)
+	}
+	return ips, ttl, nil
+}
+
+func lookup(ctx context.Context, server, hostname string, recordType dnsmessage.Type) ([]string, time.Duration, error) {
+	name, err := dnsmessage.NewName(fqdn(hostname))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid hostname %s: %v", hostname, err)
+	}
+
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: recordType, Class: dnsmessage.ClassINET}},
+	}
+	resp, err := Exchange(ctx, server, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("%s lookup of %s failed: %s", recordType, hostname, resp.RCode)
+	}
+
+	var ips []string
+	var ttl uint32
+	for _, answer := range resp.Answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = body.A[:]
+		case *dnsmessage.AAAAResource:
+			ip = body.AAAA[:]
+		default:
+			continue
+		}
+		if len(ips) == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		ips = append(ips, ip.String())
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// Exchange sends a message to a DNS server (the system one if empty) and returns its answer.
+// The ID is set by Exchange, truncated UDP answers are retried over TCP.
+func Exchange(ctx context.Context, server string, msg dnsmessage.Message) (*dnsmessage.Message, error) {
+	msg.ID = newID()
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS message: %v", err)
+	}
+
+	data, err := ExchangeRaw(ctx, "udp", server, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp dnsmessage.Message
+	err = resp.Unpack(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS answer: %v", err)
+	}
+	if resp.Truncated {
+		data, err = ExchangeRaw(ctx, "tcp", server, packed)
+		if err != nil {
+			return nil, err
+		}
+		err = resp.Unpack(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS answer: %v", err)
+		}
+	}
+	if resp.ID != msg.ID {
+		return nil, errors.New("DNS answer ID mismatch")
+	}
+
+	return &resp, nil
+}
+
+// ExchangeRaw sends a packed DNS message over udp or tcp and returns the packed answer
+func ExchangeRaw(ctx context.Context, network, server string, packed []byte) ([]byte, error) {
+	server = normalizeServer(server)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DNS server %s: %v", server, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+		_, err = conn.Write(append(frame, packed...))
+		if err != nil {
+			return nil, fmt.Errorf("failed to send DNS query to %s: %v", server, err)
+		}
+
+		var length [2]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DNS answer from %s: %v", server, err)
+		}
+		data := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DNS answer from %s: %v", server, err)
+		}
+		return data, nil
+	}
+
+	_, err = conn.Write(packed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send DNS query to %s: %v", server, err)
+	}
+	buf := make([]byte, maxUDPSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS answer from %s: %v", server, err)
+	}
+	return buf[:n], nil
+}
+
+// newID returns a random message ID
+func newID() uint16 {
+	var id [2]byte
+	_, _ = rand.Read(id[:])
+	return binary.BigEndian.Uint16(id[:])
+}
+
+// fqdn appends the root dot to a hostname
+func fqdn(hostname string) string {
+	if strings.HasSuffix(hostname, ".") {
+		return hostname
+	}
+	return hostname + "."
+}
@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/router"
+)
+
+// BackendTracker re-resolves the hostname of DNS-tracked routes when their TTL expires
+// and points the routes to the new address, exactly like an IP update would
+type BackendTracker struct {
+	manager  *router.Manager
+	resolver string
+	minTTL   time.Duration
+	maxTTL   time.Duration
+
+	tracked sync.Map // route ID -> cancel func of its resolve loop
+}
+
+func NewBackendTracker(manager *router.Manager, cfg config.BackendDNSConfig) *BackendTracker {
+	return &BackendTracker{
+		manager:  manager,
+		resolver: cfg.Resolver,
+		minTTL:   time.Duration(cfg.MinTTL) * time.Second,
+		maxTTL:   time.Duration(cfg.MaxTTL) * time.Second,
+	}
+}
+
+// IsHostname reports whether a backend address should be tracked through DNS.
+// IP addresses and single-label names (localhost, container names...) are left to the system resolver.
+func IsHostname(address string) bool {
+	return address != "" && net.ParseIP(address) == nil && strings.Contains(strings.TrimSuffix(address, "."), ".")
+}
+
+// Start tracks every route whose backend is a hostname, including the routes added later
+func (t *BackendTracker) Start() {
+	t.manager.AddRouteListener(func(route *router.Route, removed bool) {
+		if removed {
+			t.Untrack(route.RouteID)
+		} else {
+			t.Track(route)
+		}
+	})
+
+	t.manager.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*router.Route)
+		if ok {
+			t.Track(route)
+		}
+		return true
+	})
+}
+
+// Track starts following the backend hostname of a route, it does nothing for routes with an IP backend
+func (t *BackendTracker) Track(route *router.Route) {
+	host := route.BackendHostname()
+	if host == "" {
+		ip, _ := route.Backend()
+		if !IsHostname(ip) {
+			return
+		}
+		// the hostname moves to backend_host, backend_ip then holds the resolved address
+		host = ip
+		t.manager.SetBackendHost(route, host)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if previous, loaded := t.tracked.Swap(route.RouteID, cancel); loaded {
+		previous.(context.CancelFunc)()
+	}
+
+	fmt.Printf("DNS > Tracking backend %s of route %s\n", host, route.RouteID)
+	go t.run(ctx, route)
+}
+
+// Untrack stops following the backend hostname of a route
+func (t *BackendTracker) Untrack(routeID string) {
+	if cancel, loaded := t.tracked.LoadAndDelete(routeID); loaded {
+		cancel.(context.CancelFunc)()
+	}
+}
+
+func (t *BackendTracker) run(ctx context.Context, route *router.Route) {
+	for {
+		delay := t.resolve(ctx, route)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// resolve updates the route backend from DNS and returns when to resolve again
+func (t *BackendTracker) resolve(ctx context.Context, route *router.Route) time.Duration {
+	host := route.BackendHostname()
+	ips, ttl, err := LookupIP(ctx, t.resolver, host)
+	if err != nil {
+		fmt.Printf("DNS > Failed to resolve backend of route %s: %v\n", route.RouteID, err)
+		return t.minTTL
+	}
+
+	// round-robin records shouldn't move sessions around, the current address is kept while it's still listed
+	ip := ips[0]
+	if current, _ := route.Backend(); slices.Contains(ips, current) {
+		ip = current
+	}
+
+	if t.manager.UpdateBackend(route, ip, 0) {
+		fmt.Printf("DNS > %s now resolves to %s\n", host, ip)
+		err = t.manager.SaveRoutesToFile()
+		if err != nil {
+			fmt.Printf("DNS > Failed to save routes: %v\n", err)
+		}
+	}
+
+	return max(t.minTTL, min(ttl, t.maxTTL))
+}
@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	typeTSIG = 250
+	classANY = 255
+
+	tsigFudge = 300
+)
+
+// TSIGKey authenticates dynamic updates (RFC 8945)
+type TSIGKey struct {
+	Name      string
+	Secret    string // base64
+	Algorithm string // hmac-sha256 (default), hmac-sha512 or hmac-sha1
+}
+
+func (k *TSIGKey) hash() (func() hash.Hash, string, error) {
+	switch strings.ToLower(strings.TrimSuffix(k.Algorithm, ".")) {
+	case "", "hmac-sha256":
+		return sha256.New, "hmac-sha256.", nil
+	case "hmac-sha512":
+		return sha512.New, "hmac-sha512.", nil
+	case "hmac-sha1":
+		return sha1.New, "hmac-sha1.", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported TSIG algorithm %s", k.Algorithm)
+	}
+}
+
+// Update replaces the address records of names in zone with ip, through an RFC 2136 dynamic update
+// sent over TCP to server. It is signed with key when not nil.
+func Update(ctx context.Context, server, zone string, names []string, ip string, ttl uint32, key *TSIGKey) error {
+	zoneName, err := dnsmessage.NewName(fqdn(zone))
+	if err != nil {
+		return fmt.Errorf("invalid zone %s: %v", zone, err)
+	}
+
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return fmt.Errorf("invalid IP address %s", ip)
+	}
+	recordType := dnsmessage.TypeA
+	var body dnsmessage.ResourceBody
+	if ip4 := parsedIP.To4(); ip4 != nil {
+		body = &dnsmessage.AResource{A: [4]byte(ip4)}
+	} else {
+		recordType = dnsmessage.TypeAAAA
+		body = &dnsmessage.AAAAResource{AAAA: [16]byte(parsedIP.To16())}
+	}
+
+	// zone goes in the question section, the updates in the authority one (RFC 2136 section 2)
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{OpCode: 5},
+		Questions: []dnsmessage.Question{{Name: zoneName, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}},
+	}
+	for _, name := range names {
+		recordName, err := dnsmessage.NewName(fqdn(name))
+		if err != nil {
+			return fmt.Errorf("invalid record name %s: %v", name, err)
+		}
+		msg.Authorities = append(msg.Authorities,
+			// delete the existing RRset
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: recordName, Type: recordType, Class: classANY},
+				Body:   &dnsmessage.UnknownResource{Type: recordType},
+			},
+			dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: recordName, Type: recordType, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   body,
+			},
+		)
+	}
+
+	msg.ID = newID()
+	packed, err := msg.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to pack DNS update: %v", err)
+	}
+	if key != nil {
+		packed, err = signTSIG(packed, key, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := ExchangeRaw(ctx, "tcp", server, packed)
+	if err != nil {
+		return err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(data)
+	if err != nil {
+		return fmt.Errorf("invalid DNS answer: %v", err)
+	}
+	if header.ID != msg.ID {
+		return fmt.Errorf("DNS answer ID mismatch")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("update of %s refused: %s", zone, rcodeName(header.RCode))
+	}
+	return nil
+}
+
+// signTSIG appends a TSIG record to a packed message (RFC 8945 section 4.3)
+func signTSIG(packed []byte, key *TSIGKey, now time.Time) ([]byte, error) {
+	newHash, algorithm, err := key.hash()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret: %v", err)
+	}
+	keyName, err := wireName(strings.ToLower(fqdn(key.Name)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG key name %s: %v", key.Name, err)
+	}
+	algorithmName, _ := wireName(algorithm)
+
+	timeSigned := make([]byte, 6)
+	binary.BigEndian.PutUint16(timeSigned, uint16(now.Unix()>>32))
+	binary.BigEndian.PutUint32(timeSigned[2:], uint32(now.Unix()))
+
+	// the MAC covers the message followed by the TSIG variables
+	mac := hmac.New(newHash, secret)
+	mac.Write(packed)
+	mac.Write(keyName)
+	mac.Write([]byte{0, classANY, 0, 0, 0, 0}) // class, TTL
+	mac.Write(algorithmName)
+	mac.Write(timeSigned)
+	mac.Write([]byte{tsigFudge >> 8, tsigFudge & 0xff, 0, 0, 0, 0}) // fudge, error, other len
+	sum := mac.Sum(nil)
+
+	rdata := append([]byte{}, algorithmName...)
+	rdata = append(rdata, timeSigned...)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, packed[0], packed[1]) // original ID
+	rdata = append(rdata, 0, 0, 0, 0)           // error, other len
+
+	signed := append([]byte{}, packed...)
+	signed = append(signed, keyName...)
+	signed = binary.BigEndian.AppendUint16(signed, typeTSIG)
+	signed = binary.BigEndian.AppendUint16(signed, classANY)
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+
+	// one more additional record
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+	return signed, nil
+}
+
+// wireName encodes a domain name without compression
+func wireName(name string) ([]byte, error) {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid label %q", label)
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0), nil
+}
+
+func rcodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case 6:
+		return "YXDOMAIN"
+	case 7:
+		return "YXRRSET"
+	case 8:
+		return "NXRRSET"
+	case 9:
+		return "NOTAUTH"
+	case 10:
+		return "NOTZONE"
+	default:
+		return rcode.String()
+	}
+}
@@ -0,0 +1,118 @@
+package events
+
+import (
+	"slices"
+	"sync"
+	"time"
+	"tunnelled/internal/metrics"
+)
+
+type Type string
+
+const (
+	ConnectionOpened    Type = "connection_opened"
+	ConnectionClosed    Type = "connection_closed"
+	ConnectionMigrated  Type = "connection_migrated"
+	BackendConnected    Type = "backend_connected"
+	BackendDisconnected Type = "backend_disconnected"
+	ReconnectScheduled  Type = "reconnect_scheduled"
+	QueueOverflow       Type = "queue_overflow"
+	TunnelDown          Type = "tunnel_down"
+	TunnelRestored      Type = "tunnel_restored"
+	IPChanged           Type = "ip_changed"
+	IPNotifyFailed      Type = "ip_notify_failed"
+	IPNotifyRestored    Type = "ip_notify_restored"
+	RouteUnreachable    Type = "route_unreachable"
+	NATDetected         Type = "nat_detected"
+	DDNSUpdated         Type = "ddns_updated"
+	DDNSUpdateFailed    Type = "ddns_update_failed"
+	PortMappingFailed   Type = "port_mapping_failed"
+	RouteUpdated        Type = "route_updated"
+	RouteProvisioned    Type = "route_provisioned"
+	RouteWithdrawn      Type = "route_withdrawn"
+	ListenerStarted     Type = "listener_started"
+	ListenerFailed      Type = "listener_failed"
+	IPBanned            Type = "ip_banned"
+	IPUnbanned          Type = "ip_unbanned"
+	IPAutoBanned        Type = "ip_auto_banned"
+)
+
+// Types lists every event type, subscriptions to anything else would never receive an event
+var Types = []Type{
+	ConnectionOpened, ConnectionClosed, ConnectionMigrated, BackendConnected, BackendDisconnected,
+	ReconnectScheduled, QueueOverflow, TunnelDown, TunnelRestored, IPChanged, IPNotifyFailed, IPNotifyRestored,
+	RouteUnreachable, NATDetected, DDNSUpdated, DDNSUpdateFailed, PortMappingFailed, RouteUpdated,
+	RouteProvisioned, RouteWithdrawn, ListenerStarted, ListenerFailed, IPBanned, IPUnbanned, IPAutoBanned,
+}
+
+// Known reports whether t is one of the event types
+func Known(t Type) bool {
+	return slices.Contains(Types, t)
+}
+
+type Event struct {
+	Type         Type           `json:"type"`
+	Time         time.Time      `json:"time"`
+	RouteID      string         `json:"route_id,omitempty"`
+	ConnectionID string         `json:"connection_id,omitempty"`
+	Data         map[string]any `json:"data,omitempty"`
+}
+
+type subscriber struct {
+	ch    chan Event
+	types map[Type]bool // nil means every type
+}
+
+var (
+	subscribers      = make(map[*subscriber]struct{})
+	subscribersMutex sync.RWMutex
+)
+
+// Publish sends the event to every subscriber. It never blocks, slow subscribers miss events.
+func Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	subscribersMutex.RLock()
+	defer subscribersMutex.RUnlock()
+
+	for sub := range subscribers {
+		if sub.types != nil && !sub.types[event.Type] {
+			continue
+		}
+
+		select {
+		case sub.ch <- event:
+		default:
+			metrics.Inc(metrics.EventDropped, event.RouteID)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the given event types (all of them if none given)
+// and a function to cancel the subscription.
+func Subscribe(buffer int, types ...Type) (<-chan Event, func()) {
+	sub := &subscriber{
+		ch: make(chan Event, buffer),
+	}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	subscribersMutex.Lock()
+	subscribers[sub] = struct{}{}
+	subscribersMutex.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			subscribersMutex.Lock()
+			delete(subscribers, sub)
+			subscribersMutex.Unlock()
+		})
+	}
+}
@@ -3,32 +3,62 @@ package haproxy
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 )
 
+// MaxV1HeaderLength is the longest v1 header allowed by the spec, CRLF included
+const MaxV1HeaderLength = 107
+
+// ErrIncomplete is returned by the parsers when more data is needed
+var ErrIncomplete = errors.New("incomplete HAProxy header")
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
 type ProxyInfo struct {
 	SrcIP   net.IP
 	DstIP   net.IP
 	SrcPort uint16
 	DstPort uint16
 	Version int
+	TLVs    []TLV // v2 only
+
+	// Local is set for connections made by the proxy itself, like health checks (v2 LOCAL command)
+	Local bool
+	// SrcPath and DstPath are the socket paths of an AF_UNIX v2 header
+	SrcPath string
+	DstPath string
+}
+
+// HasAddresses reports whether the header carried IP addresses. LOCAL, v1 UNKNOWN, UNSPEC and
+// AF_UNIX headers don't, the addresses of the connection must be used instead.
+func (p *ProxyInfo) HasAddresses() bool {
+	return !p.Local && p.SrcIP != nil && p.DstIP != nil
 }
 
 // ParseV1 parses HAProxy protocol v1 header
-// Format: "PROXY TCP4 <src_ip> <dst_ip> <src_port> <dst_port>\r\n"
+// Format: "PROXY TCP4 <src_ip> <dst_ip> <src_port> <dst_port>\r\n", or "PROXY UNKNOWN ...\r\n" without addresses
 func ParseV1(data []byte) (*ProxyInfo, int, error) {
 	// Find the end of the header (\r\n)
 	headerEnd := bytes.Index(data, []byte("\r\n"))
-	if headerEnd == -1 {
-		return nil, 0, fmt.Errorf("incomplete HAProxy v1 header")
+	if headerEnd == -1 || headerEnd+2 > MaxV1HeaderLength {
+		if headerEnd != -1 || len(data) >= MaxV1HeaderLength {
+			return nil, 0, fmt.Errorf("HAProxy v1 header longer than %d bytes", MaxV1HeaderLength)
+		}
+		return nil, 0, ErrIncomplete
 	}
 
 	headerStr := string(data[:headerEnd])
 	parts := strings.Fields(headerStr)
 
+	// UNKNOWN may be followed by anything, which must be ignored
+	if len(parts) >= 2 && parts[0] == "PROXY" && parts[1] == "UNKNOWN" {
+		return &ProxyInfo{Version: 1}, headerEnd + 2, nil
+	}
+
 	if len(parts) != 6 || parts[0] != "PROXY" {
 		return nil, 0, fmt.Errorf("invalid HAProxy v1 header format")
 	}
@@ -66,7 +96,7 @@ func ParseV1(data []byte) (*ProxyInfo, int, error) {
 // ParseV2 parses HAProxy protocol v2 header
 func ParseV2(data []byte) (*ProxyInfo, int, error) {
 	if len(data) < 16 {
-		return nil, 0, fmt.Errorf("insufficient data for HAProxy v2 header")
+		return nil, 0, ErrIncomplete
 	}
 
 	// Check signature: \x0D\x0A\x0D\x0A\x00\x0D\x0A\x51\x55\x49\x54\x0A
@@ -84,7 +114,7 @@ func ParseV2(data []byte) (*ProxyInfo, int, error) {
 		return nil, 0, fmt.Errorf("invalid HAProxy version: %d", version)
 	}
 
-	if cmd != 1 { // PROXY command
+	if cmd > 1 { // 0 is LOCAL, 1 is PROXY
 		return nil, 0, fmt.Errorf("unsupported HAProxy command: %d", cmd)
 	}
 
@@ -93,7 +123,11 @@ func ParseV2(data []byte) (*ProxyInfo, int, error) {
 	family := (familyProto & 0xF0) >> 4
 	protocol := familyProto & 0x0F
 
-	if protocol != 1 { // TCP
+	if family > 3 {
+		return nil, 0, fmt.Errorf("unsupported address family: %d", family)
+	}
+	// Tunnels only carry streams, a DGRAM header can't describe them
+	if protocol > 1 { // UNSPEC or STREAM
 		return nil, 0, fmt.Errorf("unsupported protocol: %d", protocol)
 	}
 
@@ -102,30 +136,56 @@ func ParseV2(data []byte) (*ProxyInfo, int, error) {
 	totalHeaderSize := 16 + int(length)
 
 	if len(data) < totalHeaderSize {
-		return nil, 0, fmt.Errorf("insufficient data for complete HAProxy v2 header")
+		return nil, 0, ErrIncomplete
 	}
 
 	var srcIP, dstIP net.IP
 	var srcPort, dstPort uint16
+	var srcPath, dstPath string
+	var addressSize int
 
-	if family == 1 { // IPv4
-		if length < 12 {
-			return nil, 0, fmt.Errorf("insufficient data for IPv4 addresses")
-		}
-		srcIP = net.IP(data[16:20])
-		dstIP = net.IP(data[20:24])
-		srcPort = binary.BigEndian.Uint16(data[24:26])
-		dstPort = binary.BigEndian.Uint16(data[26:28])
-	} else if family == 2 { // IPv6
-		if length < 36 {
-			return nil, 0, fmt.Errorf("insufficient data for IPv6 addresses")
+	switch family {
+	case 1: // IPv4
+		addressSize = 12
+	case 2: // IPv6
+		addressSize = 36
+	case 3: // AF_UNIX, two 108 bytes paths
+		addressSize = 216
+	}
+	if int(length) < addressSize {
+		return nil, 0, fmt.Errorf("insufficient data for family %d addresses", family)
+	}
+
+	// LOCAL connections are made by the proxy itself, the address block must be ignored.
+	// So must it with UNSPEC, for protocols the proxy doesn't know. The TLVs are still verified.
+	local := cmd == 0 || family == 0 || protocol == 0
+	if !local {
+		switch family {
+		case 1:
+			srcIP = net.IP(bytes.Clone(data[16:20]))
+			dstIP = net.IP(bytes.Clone(data[20:24]))
+			srcPort = binary.BigEndian.Uint16(data[24:26])
+			dstPort = binary.BigEndian.Uint16(data[26:28])
+		case 2:
+			srcIP = net.IP(bytes.Clone(data[16:32]))
+			dstIP = net.IP(bytes.Clone(data[32:48]))
+			srcPort = binary.BigEndian.Uint16(data[48:50])
+			dstPort = binary.BigEndian.Uint16(data[50:52])
+		case 3:
+			srcPath = unixPath(data[16:124])
+			dstPath = unixPath(data[124:232])
 		}
-		srcIP = net.IP(data[16:32])
-		dstIP = net.IP(data[32:48])
-		srcPort = binary.BigEndian.Uint16(data[48:50])
-		dstPort = binary.BigEndian.Uint16(data[50:52])
-	} else {
-		return nil, 0, fmt.Errorf("unsupported address family: %d", family)
+	}
+
+	// TLVs fill the rest of the header
+	tlvStart := 16 + addressSize
+	tlvs, err := DecodeTLVs(data[tlvStart:totalHeaderSize])
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid HAProxy v2 TLVs: %v", err)
+	}
+	err = verifyCRC32C(data[:totalHeaderSize], tlvStart)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	return &ProxyInfo{
@@ -134,11 +194,27 @@ func ParseV2(data []byte) (*ProxyInfo, int, error) {
 		SrcPort: srcPort,
 		DstPort: dstPort,
 		Version: 2,
+		TLVs:    tlvs,
+		Local:   cmd == 0,
+		SrcPath: srcPath,
+		DstPath: dstPath,
 	}, totalHeaderSize, nil
 }
 
+// unixPath returns the NUL terminated path of an AF_UNIX address
+func unixPath(data []byte) string {
+	if end := bytes.IndexByte(data, 0); end != -1 {
+		data = data[:end]
+	}
+	return string(data)
+}
+
 // GenerateV1 generates HAProxy protocol v1 header
 func (p *ProxyInfo) GenerateV1() []byte {
+	if !p.HasAddresses() {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
 	protocol := "TCP4"
 	if p.SrcIP.To4() == nil {
 		protocol = "TCP6"
@@ -149,8 +225,9 @@ func (p *ProxyInfo) GenerateV1() []byte {
 	return []byte(header)
 }
 
-// GenerateV2 generates HAProxy protocol v2 header
-func (p *ProxyInfo) GenerateV2() []byte {
+// GenerateV2 generates HAProxy protocol v2 header followed by the given TLVs.
+// The value of a CRC32C TLV is computed, it can be left empty.
+func (p *ProxyInfo) GenerateV2(tlvs ...TLV) []byte {
 	signature := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
 	
 	versionCmd := byte(0x21) // Version 2, PROXY command
@@ -158,7 +235,13 @@ func (p *ProxyInfo) GenerateV2() []byte {
 	var familyProto byte
 	var addressData []byte
 	
-	if p.SrcIP.To4() != nil {
+	if !p.HasAddresses() {
+		// No addresses, LOCAL for health checks and UNSPEC otherwise
+		if p.Local {
+			versionCmd = 0x20 // Version 2, LOCAL command
+		}
+		familyProto = 0x00
+	} else if p.SrcIP.To4() != nil {
 		// IPv4
 		familyProto = 0x11 // IPv4, TCP
 		addressData = make([]byte, 12)
@@ -176,15 +259,25 @@ func (p *ProxyInfo) GenerateV2() []byte {
 		binary.BigEndian.PutUint16(addressData[34:36], p.DstPort)
 	}
 	
+	tlvs = append([]TLV(nil), tlvs...)
+	for i, tlv := range tlvs {
+		if tlv.Type == TypeCRC32C {
+			tlvs[i].Value = make([]byte, 4)
+		}
+	}
+	tlvData := EncodeTLVs(tlvs)
+	
 	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(addressData)))
+	binary.BigEndian.PutUint16(length, uint16(len(addressData)+len(tlvData)))
 	
-	header := make([]byte, 0, 16+len(addressData))
+	header := make([]byte, 0, 16+len(addressData)+len(tlvData))
 	header = append(header, signature...)
 	header = append(header, versionCmd)
 	header = append(header, familyProto)
 	header = append(header, length...)
 	header = append(header, addressData...)
+	header = append(header, tlvData...)
+	putCRC32C(header, 16+len(addressData))
 	
 	return header
 }
@@ -209,4 +302,12 @@ func IsHAProxyHeader(data []byte) (bool, int) {
 	}
 
 	return false, 0
+}
+
+// IsHeaderPrefix reports whether data could still become a HAProxy header, more data is needed to tell
+func IsHeaderPrefix(data []byte) bool {
+	if len(data) < 5 {
+		return bytes.HasPrefix([]byte("PROXY"), data) || bytes.HasPrefix(v2Signature, data)
+	}
+	return len(data) < 12 && bytes.HasPrefix(v2Signature, data)
 }
\ No newline at end of file
@@ -0,0 +1,196 @@
+package haproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// PROXY v2 TLV types
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+
+	// Sub-TLVs of TypeSSL
+	SubtypeSSLVersion byte = 0x21
+	SubtypeSSLCN      byte = 0x22
+	SubtypeSSLCipher  byte = 0x23
+	SubtypeSSLSigAlg  byte = 0x24
+	SubtypeSSLKeyAlg  byte = 0x25
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type TLV struct {
+	Type  byte   `json:"type"`
+	Value []byte `json:"value"`
+}
+
+// tlvNames are the TLV names accepted in the configuration
+var tlvNames = map[string]byte{
+	"alpn":      TypeALPN,
+	"authority": TypeAuthority,
+	"crc32c":    TypeCRC32C,
+	"unique_id": TypeUniqueID,
+	"ssl":       TypeSSL,
+	"netns":     TypeNetNS,
+}
+
+// ParseTLVName returns the type of a TLV named in the configuration, a known name or a number.
+// Types 0xE0 to 0xEF are free for vendors, like the ones of cloud load balancers.
+func ParseTLVName(name string) (byte, error) {
+	if tlvType, ok := tlvNames[strings.ToLower(name)]; ok {
+		return tlvType, nil
+	}
+	value, err := strconv.ParseUint(name, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown TLV %s", name)
+	}
+	return byte(value), nil
+}
+
+// EncodeTLVs encodes TLVs the way they're laid out after the v2 address block
+func EncodeTLVs(tlvs []TLV) []byte {
+	var data []byte
+	for _, tlv := range tlvs {
+		data = append(data, tlv.Type, 0, 0)
+		binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(tlv.Value)))
+		data = append(data, tlv.Value...)
+	}
+	return data
+}
+
+// DecodeTLVs decodes a block of TLVs, every TLV must be complete
+func DecodeTLVs(data []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, errors.New("truncated TLV")
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, fmt.Errorf("truncated TLV 0x%02x", data[0])
+		}
+		value := make([]byte, length)
+		copy(value, data[3:3+length])
+		tlvs = append(tlvs, TLV{Type: data[0], Value: value})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
+
+// verifyCRC32C checks the CRC32C TLV of a complete v2 header, whose TLVs start at tlvStart.
+// The checksum covers the whole header with the checksum itself set to zero.
+func verifyCRC32C(header []byte, tlvStart int) error {
+	offset := crc32cOffset(header, tlvStart)
+	if offset < 0 {
+		return nil
+	}
+
+	expected := binary.BigEndian.Uint32(header[offset : offset+4])
+	zeroed := make([]byte, len(header))
+	copy(zeroed, header)
+	copy(zeroed[offset:offset+4], []byte{0, 0, 0, 0})
+	if crc32.Checksum(zeroed, crc32cTable) != expected {
+		return errors.New("HAProxy v2 header CRC32C mismatch")
+	}
+	return nil
+}
+
+// putCRC32C fills the CRC32C TLV of a generated v2 header, if it has one
+func putCRC32C(header []byte, tlvStart int) {
+	offset := crc32cOffset(header, tlvStart)
+	if offset < 0 {
+		return
+	}
+	copy(header[offset:offset+4], []byte{0, 0, 0, 0})
+	binary.BigEndian.PutUint32(header[offset:offset+4], crc32.Checksum(header, crc32cTable))
+}
+
+// crc32cOffset returns the offset of the CRC32C value in a v2 header, -1 if there's none
+func crc32cOffset(header []byte, tlvStart int) int {
+	for i := tlvStart; i+3 <= len(header); {
+		length := int(binary.BigEndian.Uint16(header[i+1 : i+3]))
+		if header[i] == TypeCRC32C && length == 4 && i+7 <= len(header) {
+			return i + 3
+		}
+		i += 3 + length
+	}
+	return -1
+}
+
+// TLV returns the value of the first TLV of the given type
+func (p *ProxyInfo) TLV(tlvType byte) ([]byte, bool) {
+	for _, tlv := range p.TLVs {
+		if tlv.Type == tlvType {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority returns the host name sent by the client (usually the TLS SNI), empty if unknown
+func (p *ProxyInfo) Authority() string {
+	value, _ := p.TLV(TypeAuthority)
+	return string(value)
+}
+
+// ALPN returns the negotiated application protocol, empty if unknown
+func (p *ProxyInfo) ALPN() string {
+	value, _ := p.TLV(TypeALPN)
+	return string(value)
+}
+
+// SSLInfo is the content of a PP2_TYPE_SSL TLV
+type SSLInfo struct {
+	Client  byte   // PP2_CLIENT_SSL (0x01), PP2_CLIENT_CERT_CONN (0x02) and PP2_CLIENT_CERT_SESS (0x04) flags
+	Verify  uint32 // zero if the client certificate was verified
+	Version string
+	CN      string
+	Cipher  string
+	SigAlg  string
+	KeyAlg  string
+}
+
+// SSL returns the TLS details sent by the proxy, nil if there are none
+func (p *ProxyInfo) SSL() (*SSLInfo, error) {
+	value, ok := p.TLV(TypeSSL)
+	if !ok {
+		return nil, nil
+	}
+	if len(value) < 5 {
+		return nil, errors.New("truncated SSL TLV")
+	}
+
+	info := &SSLInfo{
+		Client: value[0],
+		Verify: binary.BigEndian.Uint32(value[1:5]),
+	}
+	subs, err := DecodeTLVs(value[5:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSL TLV: %v", err)
+	}
+	for _, sub := range subs {
+		switch sub.Type {
+		case SubtypeSSLVersion:
+			info.Version = string(sub.Value)
+		case SubtypeSSLCN:
+			info.CN = string(sub.Value)
+		case SubtypeSSLCipher:
+			info.Cipher = string(sub.Value)
+		case SubtypeSSLSigAlg:
+			info.SigAlg = string(sub.Value)
+		case SubtypeSSLKeyAlg:
+			info.KeyAlg = string(sub.Value)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,285 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"tunnelled/internal/control"
+	"tunnelled/internal/events"
+	"tunnelled/internal/ip"
+	"tunnelled/internal/metrics"
+	"tunnelled/internal/net"
+	"tunnelled/internal/router"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultKickReason = "Disconnected by an administrator"
+
+// eventStreamKeepAlive is how often a comment is sent on idle event streams so proxies don't cut them
+const eventStreamKeepAlive = 15 * time.Second
+
+// Status providers registered by the running subsystems, exposed on GET /api/status
+var (
+	statusProviders      = make(map[string]func() any)
+	statusProvidersMutex sync.RWMutex
+)
+
+// RegisterStatus adds a section to the status output
+func RegisterStatus(name string, provider func() any) {
+	statusProvidersMutex.Lock()
+	defer statusProvidersMutex.Unlock()
+	statusProviders[name] = provider
+}
+
+// Forwards admin commands to a tunnelled-client over its control channel, set in server mode
+var (
+	remoteAdmin      func(ctx context.Context, client string, command control.AdminCommand) (json.RawMessage, error)
+	remoteAdminMutex sync.RWMutex
+)
+
+func SetRemoteAdmin(fn func(ctx context.Context, client string, command control.AdminCommand) (json.RawMessage, error)) {
+	remoteAdminMutex.Lock()
+	defer remoteAdminMutex.Unlock()
+	remoteAdmin = fn
+}
+
+type KickRequest struct {
+	Reason string `json:"reason"`
+}
+
+// NewAdminServer starts a standalone admin HTTP server, used in server mode
+// where the client HTTP API (and its IP update endpoints) is not available.
+func NewAdminServer(address string) {
+	r := gin.Default()
+	bearerToken := "Bearer " + ReadToken()
+
+	r.GET("/api/health", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"status":    "ok",
+			"timestamp": time.Now(),
+		})
+	})
+
+	registerAdminRoutes(r, bearerToken)
+	registerBanRoutes(r, bearerToken)
+
+	// Run an admin command on a tunnelled-client, e.g. {"command": "kick", "connection_id": "..."}
+	r.POST("/api/clients/:name/admin", requireToken(bearerToken), func(c *gin.Context) {
+		var command control.AdminCommand
+		if err := c.BindJSON(&command); err != nil {
+			c.JSON(400, gin.H{"error": "bad request"})
+			return
+		}
+
+		remoteAdminMutex.RLock()
+		fn := remoteAdmin
+		remoteAdminMutex.RUnlock()
+		if fn == nil {
+			c.JSON(503, gin.H{"error": "no clients configured"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+		defer cancel()
+		result, err := fn(ctx, c.Param("name"), command)
+		if err != nil {
+			c.JSON(502, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(200, "application/json", result)
+	})
+
+	fmt.Printf("Starting admin HTTP server on %s\n", address)
+	err := r.Run(address)
+	if err != nil {
+		panic(fmt.Errorf("failed to start admin HTTP server: %v", err))
+	}
+}
+
+// requireToken rejects requests without the expected bearer token
+func requireToken(bearerToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != bearerToken {
+			c.AbortWithStatusJSON(401, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerAdminRoutes registers the admin endpoints shared by client and server mode
+func registerAdminRoutes(r *gin.Engine, bearerToken string) {
+	admin := r.Group("/api", requireToken(bearerToken))
+
+	admin.GET("/status", func(c *gin.Context) {
+		c.JSON(200, status())
+	})
+
+	// Counters per route, e.g. rejected PROXY headers
+	admin.GET("/metrics", func(c *gin.Context) {
+		c.JSON(200, metrics.Snapshot())
+	})
+
+	// List live connections grouped by route, optionally filtered with ?route_id=
+	admin.GET("/connections", func(c *gin.Context) {
+		c.JSON(200, listConnections(c.Query("route_id")))
+	})
+
+	admin.GET("/connections/:id", func(c *gin.Context) {
+		conn, ok := net.GetConnection(c.Param("id"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "connection not found"})
+			return
+		}
+
+		c.JSON(200, conn.Info())
+	})
+
+	// Forcibly close a connection, the optional reason is sent as a Minecraft disconnect message
+	admin.DELETE("/connections/:id", func(c *gin.Context) {
+		conn, ok := net.GetConnection(c.Param("id"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "connection not found"})
+			return
+		}
+
+		req := KickRequest{Reason: defaultKickReason}
+		if c.Request.ContentLength > 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": "bad request"})
+				return
+			}
+		}
+
+		messageSent, err := kick(conn, req.Reason)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"success":      true,
+			"message_sent": messageSent,
+		})
+	})
+
+	// Server-Sent Events stream of live events, filter with ?types=connection_opened,ip_changed
+	admin.GET("/events", func(c *gin.Context) {
+		var types []events.Type
+		if filter := c.Query("types"); filter != "" {
+			for _, t := range strings.Split(filter, ",") {
+				types = append(types, events.Type(strings.TrimSpace(t)))
+			}
+		}
+
+		stream, cancel := events.Subscribe(256, types...)
+		defer cancel()
+
+		keepAlive := time.NewTicker(eventStreamKeepAlive)
+		defer keepAlive.Stop()
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case event := <-stream:
+				c.SSEvent(string(event.Type), event)
+				return true
+			case <-keepAlive.C:
+				_, err := io.WriteString(w, ": keep-alive\n\n")
+				return err == nil
+			}
+		})
+	})
+}
+
+func status() gin.H {
+	statusProvidersMutex.RLock()
+	defer statusProvidersMutex.RUnlock()
+
+	status := gin.H{
+		"timestamp":   time.Now(),
+		"connections": len(net.ListConnections("")),
+	}
+	for name, provider := range statusProviders {
+		status[name] = provider()
+	}
+	return status
+}
+
+// listConnections returns the live connections grouped by route, routeID filters them when not empty
+func listConnections(routeID string) gin.H {
+	routes := make(map[string][]net.ConnectionInfo)
+	total := 0
+	for _, conn := range net.ListConnections(routeID) {
+		info := conn.Info()
+		routes[info.RouteID] = append(routes[info.RouteID], info)
+		total++
+	}
+
+	return gin.H{
+		"total":  total,
+		"routes": routes,
+	}
+}
+
+// kick closes a connection and reports whether the disconnect message could be sent
+func kick(conn *net.Connection, reason string) (bool, error) {
+	messageSent := conn.CanSendDisconnect()
+	err := conn.Kick(reason)
+	if err != nil {
+		return false, fmt.Errorf("failed to close connection: %v", err)
+	}
+
+	fmt.Printf("Admin > Closed connection %s on route %s\n", conn.ConnectionID, conn.Listener.Route.RouteID)
+	return messageSent, nil
+}
+
+// RegisterControlAdmin answers the admin commands sent by servers over the control channel
+func RegisterControlAdmin(listener *control.Listener, manager *router.Manager) {
+	listener.Handle(control.TypeAdmin, func(server string, payload json.RawMessage) (any, error) {
+		var command control.AdminCommand
+		err := json.Unmarshal(payload, &command)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin command: %v", err)
+		}
+
+		switch command.Command {
+		case "status":
+			return status(), nil
+		case "connections":
+			return listConnections(""), nil
+		case "metrics":
+			return metrics.Snapshot(), nil
+		case "reachability":
+			routes, err := ip.RoutesToProbe(manager, command.RouteID)
+			if err != nil {
+				return nil, err
+			}
+			return ip.CheckReachability(routes), nil
+		case "kick":
+			conn, ok := net.GetConnection(command.ConnectionID)
+			if !ok {
+				return nil, fmt.Errorf("connection %s not found", command.ConnectionID)
+			}
+			if command.Reason == "" {
+				command.Reason = defaultKickReason
+			}
+			messageSent, err := kick(conn, command.Reason)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("Admin > Kick requested by server %s\n", server)
+			return gin.H{"success": true, "message_sent": messageSent}, nil
+		default:
+			return nil, fmt.Errorf("unknown admin command %s", command.Command)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package http
+
+import (
+	"time"
+	"tunnelled/internal/bans"
+	"tunnelled/internal/net"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BanRequest struct {
+	IP     string `json:"ip"`            // IP or CIDR
+	TTL    int    `json:"ttl,omitempty"` // seconds, permanent if 0
+	Reason string `json:"reason,omitempty"`
+	Kick   bool   `json:"kick,omitempty"` // close the live sessions of the banned players
+}
+
+// registerBanRoutes registers the endpoints managing the temporary bans of the client
+func registerBanRoutes(r *gin.Engine, bearerToken string) {
+	admin := r.Group("/api/bans", requireToken(bearerToken))
+
+	admin.GET("", func(c *gin.Context) {
+		c.JSON(200, bans.List())
+	})
+
+	// Ban an IP or a range, e.g. {"ip": "198.51.100.7", "ttl": 86400, "reason": "griefing", "kick": true}
+	admin.POST("", func(c *gin.Context) {
+		var req BanRequest
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "bad request"})
+			return
+		}
+		if req.TTL < 0 {
+			c.JSON(400, gin.H{"error": "ttl must be positive"})
+			return
+		}
+
+		ban, err := bans.Add(req.IP, time.Duration(req.TTL)*time.Second, req.Reason, "admin")
+		if ban == nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The ban is enforced even if it couldn't be saved, so are the kicks
+		kicked := 0
+		if req.Kick {
+			kicked = net.KickBanned(ban)
+		}
+		response := gin.H{"success": true, "ban": ban, "kicked": kicked}
+		if err != nil {
+			response["save_error"] = "ban applied but not saved: " + err.Error()
+		}
+		c.JSON(200, response)
+	})
+
+	// Lift a ban, with the same IP or range it was added with: DELETE /api/bans?ip=198.51.100.0/24
+	admin.DELETE("", func(c *gin.Context) {
+		found, err := bans.Remove(c.Query("ip"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if !found {
+			c.JSON(404, gin.H{"error": "ban not found"})
+			return
+		}
+		c.JSON(200, gin.H{"success": true})
+	})
+}
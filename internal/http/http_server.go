@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 	"tunnelled/internal/config"
+	"tunnelled/internal/events"
 	"tunnelled/internal/ip"
 	"tunnelled/internal/router"
 
@@ -37,13 +38,7 @@ func GetPublicIP() string {
 	return currentPublicIP
 }
 
-func NewHTTPServer(manager *router.Manager) {
-	// Load client config for HTTP port
-	clientConfig, err := config.LoadClientConfig()
-	if err != nil {
-		panic(fmt.Errorf("failed to load client config: %v", err))
-	}
-
+func NewHTTPServer(manager *router.Manager, clientConfig *config.ClientConfig) {
 	r := gin.Default()
 	bearerToken := "Bearer " + ReadToken()
 
@@ -55,64 +50,55 @@ func NewHTTPServer(manager *router.Manager) {
 		})
 	})
 
-	// Endpoint to receive IP updates from server
-	r.POST("/api/ip/update", func(c *gin.Context) {
-		// Check bearer token
-		token := c.GetHeader("Authorization")
-		if token != bearerToken {
-			c.JSON(401, gin.H{
-				"success": false,
-				"message": "unauthorized",
-			})
-			return
-		}
-
-		var updateReq ip.IPUpdateRequest
-		if err := c.BindJSON(&updateReq); err != nil {
-			c.JSON(400, gin.H{
-				"success": false,
-				"message": "invalid request format",
-			})
-			return
-		}
-
-		// Update backend IP for specified endpoints
-		updatedCount := 0
-		for _, routeID := range updateReq.Endpoints {
-			value, ok := manager.Routes.Load(routeID)
-			if !ok {
-				fmt.Printf("Warning: route %s not found\n", routeID)
-				continue
+	// IP updates over HTTP, the fallback of the control channel
+	if clientConfig.IPUpdateHTTP {
+		// Endpoint to receive IP updates from server
+		r.POST("/api/ip/update", func(c *gin.Context) {
+			// Check bearer token
+			token := c.GetHeader("Authorization")
+			if token != bearerToken {
+				c.JSON(401, gin.H{
+					"success": false,
+					"message": "unauthorized",
+				})
+				return
 			}
 
-			route, ok := value.(*router.Route)
-			if !ok {
-				fmt.Printf("Warning: invalid route type for %s\n", routeID)
-				continue
+			var updateReq ip.IPUpdateRequest
+			if err := c.BindJSON(&updateReq); err != nil {
+				c.JSON(400, gin.H{
+					"success": false,
+					"message": "invalid request format",
+				})
+				return
 			}
 
-			route.BackendIP = updateReq.NewIP
-			updatedCount++
-			fmt.Printf("Updated route %s backend IP to %s\n", routeID, updateReq.NewIP)
-		}
-
-		// Save updated routes to file
-		if updatedCount > 0 {
-			err := manager.SaveRoutesToFile()
+			resp, err := ip.ApplyUpdate(manager, updateReq)
 			if err != nil {
 				c.JSON(500, gin.H{
 					"success": false,
-					"message": fmt.Sprintf("failed to save routes: %v", err),
+					"message": err.Error(),
 				})
 				return
 			}
-		}
 
-		c.JSON(200, gin.H{
-			"success": true,
-			"message": fmt.Sprintf("updated %d routes", updatedCount),
+			c.JSON(200, resp)
 		})
-	})
+
+		// Current backends of every route, used by the server to reconcile after IP updates
+		r.GET("/api/ip/routes", func(c *gin.Context) {
+			token := c.GetHeader("Authorization")
+			if token != bearerToken {
+				c.JSON(401, gin.H{
+					"success": false,
+					"message": "unauthorized",
+				})
+				return
+			}
+
+			c.JSON(200, ip.CurrentRouteState(manager))
+		})
+	}
 
 	// Existing route update endpoint
 	r.POST("/update", func(c *gin.Context) {
@@ -143,6 +129,11 @@ func NewHTTPServer(manager *router.Manager) {
 
 		route.BindIP = req.IP
 		route.BindPort = req.Port
+		events.Publish(events.Event{
+			Type:    events.RouteUpdated,
+			RouteID: req.RouteID,
+			Data:    map[string]any{"bind_ip": req.IP, "bind_port": req.Port},
+		})
 
 		err := manager.SaveRoutesToFile()
 		if err != nil {
@@ -153,10 +144,76 @@ func NewHTTPServer(manager *router.Manager) {
 		c.JSON(200, gin.H{"success": true})
 	})
 
+	// Dial back the server on the backend of every route (or ?route_id=) to check it's reachable
+	r.GET("/api/reachability", requireToken(bearerToken), func(c *gin.Context) {
+		routes, err := ip.RoutesToProbe(manager, c.Query("route_id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"routes": ip.CheckReachability(routes)})
+	})
+
+	// ACL of a route, checked against the player IP before the tunnel is dialed
+	r.GET("/api/routes/:id/acl", requireToken(bearerToken), func(c *gin.Context) {
+		route, ok := manager.GetRoute(c.Param("id"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "route not found"})
+			return
+		}
+		acl := route.CurrentACL()
+		if acl == nil {
+			c.JSON(200, router.ACL{})
+			return
+		}
+		c.JSON(200, acl)
+	})
+
+	// Replace the ACL of a route with {"allow": [...], "deny": [...]}, empty lists remove it
+	r.PUT("/api/routes/:id/acl", requireToken(bearerToken), func(c *gin.Context) {
+		route, ok := manager.GetRoute(c.Param("id"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "route not found"})
+			return
+		}
+
+		var req router.ACL
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		acl := &req
+		if len(req.Allow) == 0 && len(req.Deny) == 0 {
+			acl = nil
+		}
+		manager.SetACL(route, acl)
+
+		err := manager.SaveRoutesToFile()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "failed to save routes"})
+			return
+		}
+		c.JSON(200, gin.H{"success": true})
+	})
+
+	// Reload the ACLs of every route from the routes file, after editing it by hand
+	r.POST("/api/acl/reload", requireToken(bearerToken), func(c *gin.Context) {
+		reloaded, err := manager.ReloadACLs()
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "routes": reloaded})
+	})
+
+	registerAdminRoutes(r, bearerToken)
+	registerBanRoutes(r, bearerToken)
+
 	// Start server on configured port
 	address := fmt.Sprintf(":%d", clientConfig.HTTPPort)
 	fmt.Printf("Starting HTTP server on %s\n", address)
-	err = r.Run(address)
+	err := r.Run(address)
 	if err != nil {
 		panic(fmt.Errorf("failed to start HTTP server: %v", err))
 	}
@@ -0,0 +1,46 @@
+package ip
+
+import (
+	"encoding/json"
+	"fmt"
+	"tunnelled/internal/control"
+	"tunnelled/internal/router"
+)
+
+// CurrentRouteState returns the backend of every client route
+func CurrentRouteState(manager *router.Manager) RouteStateResponse {
+	routes := make([]RouteState, 0)
+	manager.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*router.Route)
+		if ok {
+			backendIP, backendPort := route.Backend()
+			routes = append(routes, RouteState{
+				RouteID:     route.RouteID,
+				BackendIP:   backendIP,
+				BackendPort: backendPort,
+				BackendHost: route.BackendHostname(),
+				Link:        route.Link,
+			})
+		}
+		return true
+	})
+	return RouteStateResponse{Routes: routes}
+}
+
+// RegisterControlHandlers answers the IP updates and route state requests sent over the control channel
+func RegisterControlHandlers(listener *control.Listener, manager *router.Manager) {
+	listener.Handle(control.TypeIPChange, func(server string, payload json.RawMessage) (any, error) {
+		var updateReq IPUpdateRequest
+		err := json.Unmarshal(payload, &updateReq)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP update: %v", err)
+		}
+		// a server only updates the routes linked to itself
+		updateReq.Server = server
+		return ApplyUpdate(manager, updateReq)
+	})
+
+	listener.Handle(control.TypeRouteState, func(server string, payload json.RawMessage) (any, error) {
+		return CurrentRouteState(manager), nil
+	})
+}
@@ -1,52 +1,150 @@
 package ip
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"strings"
+	"net"
+	"sync"
 	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/events"
+)
+
+type Strategy string
+
+const (
+	StrategyFirstSuccess Strategy = "first_success" // providers are asked in order, the first answer wins
+	StrategyQuorum       Strategy = "quorum"        // more than half of the providers must agree
+	StrategyAllAgree     Strategy = "all_agree"     // every provider must answer with the same IP
 )
 
 type DiscoveryService struct {
 	currentIP     string
 	lastChecked   time.Time
 	checkInterval time.Duration
-	httpClient    *http.Client
+
+	providers []Provider
+	strategy  Strategy
+	timeout   time.Duration
+
+	natReport *NATReport
+	wanSource WANSource
+
+	// Guards currentIP and natReport, which are read by the admin API
+	mutex sync.RWMutex
 }
 
-func NewDiscoveryService(checkIntervalSeconds int) *DiscoveryService {
+func NewDiscoveryService(checkIntervalSeconds int, discoveryConfig config.IPDiscoveryConfig) (*DiscoveryService, error) {
+	providers, err := NewProviders(discoveryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	strategy := Strategy(discoveryConfig.Strategy)
+	switch strategy {
+	case "":
+		strategy = StrategyFirstSuccess
+	case StrategyFirstSuccess, StrategyQuorum, StrategyAllAgree:
+	default:
+		return nil, fmt.Errorf("unknown IP discovery strategy: %q", discoveryConfig.Strategy)
+	}
+
+	timeout := 10 * time.Second
+	if discoveryConfig.Timeout > 0 {
+		timeout = time.Duration(discoveryConfig.Timeout) * time.Second
+	}
+
 	return &DiscoveryService{
 		checkInterval: time.Duration(checkIntervalSeconds) * time.Second,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
-	}
+		providers:     providers,
+		strategy:      strategy,
+		timeout:       timeout,
+	}, nil
 }
 
-// GetPublicIP fetches the public IP from checkip.amazonaws.com
+// WANSource reports the external address of the home router, it tells carrier-grade NAT apart from a public WAN
+type WANSource interface {
+	WANAddress(ctx context.Context) (string, error)
+}
+
+// SetWANSource makes the NAT checks compare the router's WAN address with the address seen from the internet
+func (d *DiscoveryService) SetWANSource(source WANSource) {
+	d.wanSource = source
+}
+
+// AddProvider registers an extra discovery source, used by subsystems that learn the IP on their own
+func (d *DiscoveryService) AddProvider(provider Provider) {
+	d.providers = append(d.providers, provider)
+}
+
+// GetPublicIP asks the configured providers for the public IP and combines their answers with the strategy
 func (d *DiscoveryService) GetPublicIP() (string, error) {
-	resp, err := d.httpClient.Get("https://checkip.amazonaws.com")
-	if err != nil {
-		return "", fmt.Errorf("failed to fetch public IP: %v", err)
+	if d.strategy == StrategyFirstSuccess {
+		// Each provider gets the whole timeout, a hanging one must leave time for the fallbacks
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout*time.Duration(len(d.providers)))
+		defer cancel()
+
+		var errs []error
+		for _, provider := range d.providers {
+			providerCtx, providerCancel := context.WithTimeout(ctx, d.timeout)
+			ip, err := provider.PublicIP(providerCtx)
+			providerCancel()
+			if err == nil {
+				return ip, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %v", provider.Name(), err))
+		}
+		return "", fmt.Errorf("failed to fetch public IP: %v", errors.Join(errs...))
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("checkip.amazonaws.com returned status %d", resp.StatusCode)
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	type answer struct {
+		provider Provider
+		ip       string
+		err      error
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %v", err)
+	answers := make(chan answer, len(d.providers))
+	for _, provider := range d.providers {
+		go func(provider Provider) {
+			ip, err := provider.PublicIP(ctx)
+			answers <- answer{provider: provider, ip: ip, err: err}
+		}(provider)
+	}
+
+	votes := make(map[string]int)
+	var errs []error
+	for range d.providers {
+		a := <-answers
+		if a.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", a.provider.Name(), a.err))
+			continue
+		}
+		votes[a.ip]++
 	}
 
-	ip := strings.TrimSpace(string(body))
-	if ip == "" {
-		return "", fmt.Errorf("empty IP response from checkip.amazonaws.com")
+	bestIP, bestVotes := "", 0
+	for ip, count := range votes {
+		if count > bestVotes {
+			bestIP, bestVotes = ip, count
+		}
 	}
 
-	return ip, nil
+	switch d.strategy {
+	case StrategyQuorum:
+		if bestVotes*2 > len(d.providers) {
+			return bestIP, nil
+		}
+		return "", fmt.Errorf("no quorum on public IP (votes: %v, errors: %v)", votes, errors.Join(errs...))
+	default:
+		if len(votes) == 1 && len(errs) == 0 {
+			return bestIP, nil
+		}
+		return "", fmt.Errorf("providers disagree on public IP (votes: %v, errors: %v)", votes, errors.Join(errs...))
+	}
 }
 
 // CheckAndUpdateIP checks if IP has changed and returns the new IP if it has
@@ -66,8 +164,14 @@ func (d *DiscoveryService) CheckAndUpdateIP() (string, bool, error) {
 	// Check if IP has changed
 	if newIP != d.currentIP {
 		oldIP := d.currentIP
+		d.mutex.Lock()
 		d.currentIP = newIP
+		d.mutex.Unlock()
 		fmt.Printf("Public IP changed: %s -> %s\n", oldIP, newIP)
+		events.Publish(events.Event{
+			Type: events.IPChanged,
+			Data: map[string]any{"old_ip": oldIP, "new_ip": newIP},
+		})
 		return newIP, true, nil
 	}
 
@@ -76,6 +180,8 @@ func (d *DiscoveryService) CheckAndUpdateIP() (string, bool, error) {
 
 // GetCurrentIP returns the currently known IP without checking
 func (d *DiscoveryService) GetCurrentIP() string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	return d.currentIP
 }
 
@@ -83,4 +189,72 @@ func (d *DiscoveryService) GetCurrentIP() string {
 func (d *DiscoveryService) ForceCheck() (string, bool, error) {
 	d.lastChecked = time.Time{} // Reset last checked to force update
 	return d.CheckAndUpdateIP()
-}
\ No newline at end of file
+}
+
+// CheckNAT classifies the NAT in front of this machine with the first STUN provider, if any is configured
+func (d *DiscoveryService) CheckNAT() (*NATReport, error) {
+	var stunProvider *STUNProvider
+	for _, provider := range d.providers {
+		if p, ok := provider.(*STUNProvider); ok {
+			stunProvider = p
+			break
+		}
+	}
+	if stunProvider == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	report, err := stunProvider.ClassifyNAT(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("NAT classification failed: %v", err)
+	}
+
+	// Behind carrier-grade NAT, the router's WAN address is a shared one, or at least not the one seen by STUN
+	if d.wanSource != nil && report.Type != NATOpen {
+		wanIP, err := d.wanSource.WANAddress(ctx)
+		if err != nil {
+			fmt.Printf("NAT > Cannot read the router WAN address: %v\n", err)
+		} else if wan := net.ParseIP(wanIP); wan != nil {
+			report.WANIP = wan.String()
+			if cgnatRange.Contains(wan) || !wan.Equal(net.ParseIP(report.PublicIP)) {
+				report.CGNAT = true
+			}
+		}
+	}
+	d.mutex.Lock()
+	d.natReport = report
+	d.mutex.Unlock()
+
+	fmt.Printf("NAT > type %s, public address %s:%d (local port %d)\n", report.Type, report.PublicIP, report.MappedPort, report.LocalPort)
+	if report.CGNAT && report.WANIP != "" {
+		fmt.Printf("NAT > Warning: the router WAN address %s is not the public address, the connection looks to be behind carrier-grade NAT and the client won't be able to reach it\n", report.WANIP)
+	} else if report.CGNAT {
+		fmt.Println("NAT > Warning: this machine looks to be behind carrier-grade NAT, the client won't be able to reach it on the public IP")
+	}
+	if report.Type == NATAddressDependent || !report.PortPreserved {
+		fmt.Println("NAT > Warning: the router remaps ports, make sure the routes are forwarded explicitly")
+	}
+
+	events.Publish(events.Event{
+		Type: events.NATDetected,
+		Data: map[string]any{
+			"type":           report.Type,
+			"public_ip":      report.PublicIP,
+			"mapped_port":    report.MappedPort,
+			"port_preserved": report.PortPreserved,
+			"wan_ip":         report.WANIP,
+			"cgnat":          report.CGNAT,
+		},
+	})
+	return report, nil
+}
+
+// GetNATReport returns the last NAT classification, nil if none ran
+func (d *DiscoveryService) GetNATReport() *NATReport {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.natReport
+}
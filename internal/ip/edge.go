@@ -0,0 +1,536 @@
+package ip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/control"
+	"tunnelled/internal/events"
+	"tunnelled/internal/provision"
+	"tunnelled/internal/router"
+)
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 2 * time.Minute
+)
+
+// NotifyFailedThreshold is how many notifications of a client must fail in a row before it's reported,
+// a single outage is reported once and not on every retry
+var NotifyFailedThreshold = 5
+
+// EdgeStatus is the delivery state of a client edge, exposed in the server status
+type EdgeStatus struct {
+	Name                string    `json:"name"`
+	Endpoint            string    `json:"endpoint"`
+	DesiredIP           string    `json:"desired_ip"`
+	Acknowledged        bool      `json:"acknowledged"`
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+
+	Reachability []ReachabilityResult `json:"reachability,omitempty"` // client probes after the last update
+
+	Control *control.ChannelStatus `json:"control,omitempty"`
+}
+
+// ClientEdge delivers IP changes to a single tunnelled-client
+type ClientEdge struct {
+	name           string
+	serverName     string
+	routeManager   *router.Manager
+	clientEndpoint string
+	bearerToken    string
+	routeMap       map[string]string // server route ID -> client route ID, empty for identical IDs
+	httpClient     *http.Client
+	channel        *control.Channel // control channel, nil to only use the HTTP API
+	provision      []config.ProvisionRouteConfig
+
+	// Delivery state, the desired IP is pushed until the client acknowledges it
+	stateMutex          sync.Mutex
+	desiredIP           string
+	acknowledged        bool
+	lastAttempt         time.Time
+	lastSuccess         time.Time
+	lastError           string
+	consecutiveFailures int
+	reachability        []ReachabilityResult
+	wake                chan struct{}
+	reconcileInterval   time.Duration
+}
+
+func newClientEdge(routeManager *router.Manager, serverName string, clientConfig config.ClientEdgeConfig, token string, reconcileIntervalSeconds int) *ClientEdge {
+	e := &ClientEdge{
+		name:           clientConfig.Name,
+		serverName:     serverName,
+		routeManager:   routeManager,
+		clientEndpoint: clientConfig.Endpoint,
+		bearerToken:    "Bearer " + token,
+		routeMap:       clientConfig.Routes,
+		provision:      clientConfig.Provision,
+		httpClient: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+		wake:              make(chan struct{}, 1),
+		reconcileInterval: time.Duration(reconcileIntervalSeconds) * time.Second,
+	}
+
+	if clientConfig.Control != "" {
+		e.channel = control.NewChannel(clientConfig.Control, serverName, token)
+		e.channel.OnConnect = e.onControlConnect
+	}
+	return e
+}
+
+// onControlConnect syncs the provisioned routes and pushes the desired IP again, the channel usually
+// comes back right after an IP change
+func (e *ClientEdge) onControlConnect() {
+	e.stateMutex.Lock()
+	ip := e.desiredIP
+	e.stateMutex.Unlock()
+
+	// Routes are provisioned even when no IP delivery is pending
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	err := e.syncRoutes(ctx, ip)
+	cancel()
+	if err != nil {
+		fmt.Printf("Provision > Client %s: %v\n", e.name, err)
+	}
+
+	if ip != "" {
+		e.SetIP(ip)
+	}
+}
+
+// SetIP schedules the delivery of a new public IP, it returns immediately
+func (e *ClientEdge) SetIP(ip string) {
+	e.stateMutex.Lock()
+	e.desiredIP = ip
+	e.acknowledged = false
+	e.stateMutex.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *ClientEdge) Status() EdgeStatus {
+	e.stateMutex.Lock()
+	defer e.stateMutex.Unlock()
+
+	status := EdgeStatus{
+		Name:                e.name,
+		Endpoint:            e.clientEndpoint,
+		DesiredIP:           e.desiredIP,
+		Acknowledged:        e.acknowledged,
+		LastAttempt:         e.lastAttempt,
+		LastSuccess:         e.lastSuccess,
+		LastError:           e.lastError,
+		ConsecutiveFailures: e.consecutiveFailures,
+		Reachability:        e.reachability,
+	}
+	if e.channel != nil {
+		channelStatus := e.channel.Status()
+		status.Control = &channelStatus
+	}
+	return status
+}
+
+// Admin sends an admin command to the client over the control channel
+func (e *ClientEdge) Admin(ctx context.Context, command control.AdminCommand) (json.RawMessage, error) {
+	if e.channel == nil {
+		return nil, fmt.Errorf("client %s has no control channel", e.name)
+	}
+	return e.channel.RequestRaw(ctx, control.TypeAdmin, command)
+}
+
+// Run delivers the desired IP until the client acknowledges it, retrying with exponential backoff,
+// and periodically checks that the client still uses it. It never returns.
+func (e *ClientEdge) Run() {
+	if e.channel != nil {
+		go e.channel.Run()
+	}
+
+	retryDelay := minRetryDelay
+
+	var reconcile <-chan time.Time
+	if e.reconcileInterval > 0 {
+		ticker := time.NewTicker(e.reconcileInterval)
+		defer ticker.Stop()
+		reconcile = ticker.C
+	}
+
+	for {
+		e.stateMutex.Lock()
+		ip, pending := e.desiredIP, !e.acknowledged && e.desiredIP != ""
+		e.stateMutex.Unlock()
+
+		if pending {
+			err := e.NotifyClientOfIPChange(ip)
+			if err == nil {
+				e.markAcknowledged(ip)
+				retryDelay = minRetryDelay
+				continue
+			}
+
+			fmt.Printf("Failed to notify client %s of IP change, retrying in %v: %v\n", e.name, retryDelay, err)
+			select {
+			case <-time.After(retryDelay):
+			case <-e.wake:
+			}
+			retryDelay *= 2
+			if retryDelay > maxRetryDelay {
+				retryDelay = maxRetryDelay
+			}
+			continue
+		}
+
+		select {
+		case <-e.wake:
+		case <-reconcile:
+			e.reconcile(ip)
+		}
+	}
+}
+
+func (e *ClientEdge) markAcknowledged(ip string) {
+	e.stateMutex.Lock()
+	defer e.stateMutex.Unlock()
+	// A newer IP may have been set while we were delivering this one
+	if e.desiredIP == ip {
+		e.acknowledged = true
+	}
+}
+
+// serverRoutes returns the server routes sent to this edge
+func (e *ClientEdge) serverRoutes() []*router.Route {
+	var routes []*router.Route
+	e.routeManager.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*router.Route)
+		if !ok {
+			return true
+		}
+		if _, mapped := e.routeMap[route.RouteID]; len(e.routeMap) == 0 || mapped {
+			routes = append(routes, route)
+		}
+		return true
+	})
+	return routes
+}
+
+// clientRouteID returns the client route targeted by a server route, for clients without links
+func (e *ClientEdge) clientRouteID(serverRouteID string) string {
+	if clientRouteID, ok := e.routeMap[serverRouteID]; ok {
+		return clientRouteID
+	}
+	return serverRouteID
+}
+
+// reconcile fetches the backends of the client routes and schedules a new push if any of them drifted
+func (e *ClientEdge) reconcile(ip string) {
+	if ip == "" {
+		return
+	}
+
+	state, err := e.FetchClientRoutes()
+	if err != nil {
+		fmt.Printf("IP reconciliation with client %s failed: %v\n", e.name, err)
+		return
+	}
+
+	serverRoutes := make(map[string]*router.Route)
+	for _, route := range e.serverRoutes() {
+		serverRoutes[route.RouteID] = route
+	}
+
+	// Clients linking their routes to us are checked through the links, IP and port
+	drifted := false
+	linked := false
+	for _, clientRoute := range state {
+		if clientRoute.Link == nil || clientRoute.Link.Server != e.serverName {
+			continue
+		}
+		linked = true
+
+		serverRoute, ok := serverRoutes[clientRoute.Link.Route]
+		if !ok {
+			fmt.Printf("IP reconciliation: route %s on client %s is linked to unknown route %s\n", clientRoute.RouteID, e.name, clientRoute.Link.Route)
+			continue
+		}
+		if clientRoute.BackendIP != ip || clientRoute.BackendPort != serverRoute.BindPort {
+			fmt.Printf("IP reconciliation: route %s on client %s points to %s:%d instead of %s:%d\n",
+				clientRoute.RouteID, e.name, clientRoute.BackendIP, clientRoute.BackendPort, ip, serverRoute.BindPort)
+			drifted = true
+		}
+	}
+
+	if !linked {
+		clientRoutes := make(map[string]RouteState, len(state))
+		for _, route := range state {
+			clientRoutes[route.RouteID] = route
+		}
+
+		for serverRouteID := range serverRoutes {
+			clientRouteID := e.clientRouteID(serverRouteID)
+			clientRoute, ok := clientRoutes[clientRouteID]
+			if !ok {
+				fmt.Printf("IP reconciliation: route %s (server route %s) does not exist on client %s\n", clientRouteID, serverRouteID, e.name)
+				continue
+			}
+			if clientRoute.BackendIP != ip {
+				fmt.Printf("IP reconciliation: route %s on client %s points to %s instead of %s\n", clientRouteID, e.name, clientRoute.BackendIP, ip)
+				drifted = true
+			}
+		}
+	}
+
+	if drifted {
+		e.SetIP(ip)
+	}
+}
+
+// FetchClientRoutes returns the current backends of the client routes,
+// through the control channel when it's up and the HTTP API otherwise
+func (e *ClientEdge) FetchClientRoutes() ([]RouteState, error) {
+	if e.channel != nil && (e.channel.Connected() || e.clientEndpoint == "") {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		var stateResp RouteStateResponse
+		err := e.channel.Request(ctx, control.TypeRouteState, nil, &stateResp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch client routes: %v", err)
+		}
+		return stateResp.Routes, nil
+	}
+
+	url := fmt.Sprintf("%s/api/ip/routes", e.clientEndpoint)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", e.bearerToken)
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch client routes: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("client returned status %d for route state", resp.StatusCode)
+	}
+
+	var stateResp RouteStateResponse
+	err = json.NewDecoder(resp.Body).Decode(&stateResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode client response: %v", err)
+	}
+	return stateResp.Routes, nil
+}
+
+// NotifyClientOfIPChange sends IP update to client with list of endpoints to update
+func (e *ClientEdge) NotifyClientOfIPChange(newIP string) error {
+	err := e.notify(newIP)
+
+	e.stateMutex.Lock()
+	e.lastAttempt = time.Now()
+	previousFailures := e.consecutiveFailures
+	if err != nil {
+		e.consecutiveFailures++
+		e.lastError = err.Error()
+	} else {
+		e.consecutiveFailures = 0
+		e.lastError = ""
+		e.lastSuccess = e.lastAttempt
+	}
+	failures := e.consecutiveFailures
+	e.stateMutex.Unlock()
+
+	threshold := max(NotifyFailedThreshold, 1)
+	if err == nil && previousFailures >= threshold {
+		events.Publish(events.Event{
+			Type: events.IPNotifyRestored,
+			Data: map[string]any{
+				"ip":              newIP,
+				"client":          e.name,
+				"client_endpoint": e.clientEndpoint,
+				"failed_attempts": previousFailures,
+			},
+		})
+	}
+	if err != nil && failures == threshold {
+		events.Publish(events.Event{
+			Type: events.IPNotifyFailed,
+			Data: map[string]any{
+				"ip":                   newIP,
+				"client":               e.name,
+				"client_endpoint":      e.clientEndpoint,
+				"consecutive_failures": failures,
+				"error":                err.Error(),
+			},
+		})
+	}
+	return err
+}
+
+func (e *ClientEdge) notify(newIP string) error {
+	// Both the links and the legacy endpoints are sent, the client picks what it's configured for
+	var endpoints []string
+	var routes []RouteUpdate
+	for _, route := range e.serverRoutes() {
+		endpoints = append(endpoints, e.clientRouteID(route.RouteID))
+		routes = append(routes, RouteUpdate{Route: route.RouteID, Port: route.BindPort})
+	}
+
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no routes found to update")
+	}
+
+	updateReq := IPUpdateRequest{
+		Endpoints: endpoints,
+		NewIP:     newIP,
+		Server:    e.serverName,
+		Routes:    routes,
+	}
+
+	updateResp, err := e.sendUpdate(updateReq)
+	if err != nil {
+		return err
+	}
+	e.recordReachability(newIP, updateResp.Reachability)
+
+	if !updateResp.Success {
+		return fmt.Errorf("client rejected IP update: %s", updateResp.Message)
+	}
+	if len(updateResp.Unlinked) > 0 {
+		fmt.Printf("Client %s doesn't link any route to %v\n", e.name, updateResp.Unlinked)
+	}
+
+	fmt.Printf("Successfully notified client %s of IP change. Updated endpoints: %v -> %s\n", e.name, endpoints, newIP)
+	return nil
+}
+
+// recordReachability stores the probes of the client and reports the routes that can't reach us
+func (e *ClientEdge) recordReachability(ip string, results []ReachabilityResult) {
+	e.stateMutex.Lock()
+	e.reachability = results
+	e.stateMutex.Unlock()
+
+	for _, result := range results {
+		if result.Reachable {
+			continue
+		}
+		fmt.Printf("Client %s can't reach %s for route %s: %s\n", e.name, result.Address, result.RouteID, result.Error)
+		events.Publish(events.Event{
+			Type:    events.RouteUnreachable,
+			RouteID: result.RouteID,
+			Data: map[string]any{
+				"client":  e.name,
+				"ip":      ip,
+				"address": result.Address,
+				"error":   result.Error,
+			},
+		})
+	}
+}
+
+// sendUpdate delivers an IP update through the control channel when it's up and the HTTP API otherwise
+func (e *ClientEdge) sendUpdate(updateReq IPUpdateRequest) (*IPUpdateResponse, error) {
+	var updateResp IPUpdateResponse
+
+	if e.channel != nil && (e.channel.Connected() || e.clientEndpoint == "") {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		// provisioned routes are created first so the update reaches them too,
+		// an empty list withdraws the routes we provisioned before
+		err := e.syncRoutes(ctx, updateReq.NewIP)
+		if err != nil {
+			return nil, err
+		}
+
+		err = e.channel.Request(ctx, control.TypeIPChange, updateReq, &updateResp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send IP update to client: %v", err)
+		}
+		return &updateResp, nil
+	}
+
+	jsonData, err := json.Marshal(updateReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal IP update request: %v", err)
+	}
+
+	// Send to client with Bearer token
+	url := fmt.Sprintf("%s/api/ip/update", e.clientEndpoint)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", e.bearerToken)
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send IP update to client: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("client returned status %d for IP update", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&updateResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode client response: %v", err)
+	}
+	return &updateResp, nil
+}
+
+// syncRoutes sends the routes this server provisions on the client, rejected routes are only logged
+func (e *ClientEdge) syncRoutes(ctx context.Context, ip string) error {
+	syncReq := provision.SyncRequest{IP: ip}
+	for _, routeConfig := range e.provision {
+		serverRoute, ok := e.routeManager.GetRoute(routeConfig.ServerRoute)
+		if !ok {
+			fmt.Printf("Provision > Route %s for client %s targets unknown server route %s\n", routeConfig.RouteID, e.name, routeConfig.ServerRoute)
+			continue
+		}
+
+		haProxy := router.HAProxyVersion(routeConfig.HAProxy)
+		if haProxy == "" {
+			haProxy = router.HAProxyOFF
+		}
+		syncReq.Routes = append(syncReq.Routes, provision.RouteSpec{
+			RouteID:     routeConfig.RouteID,
+			ServerRoute: routeConfig.ServerRoute,
+			BindIP:      routeConfig.BindIP,
+			BindPort:    routeConfig.BindPort,
+			HAProxy:     haProxy,
+			BackendPort: serverRoute.BindPort,
+			Metadata:    routeConfig.Metadata,
+		})
+	}
+
+	var syncResp provision.SyncResponse
+	err := e.channel.Request(ctx, control.TypeRouteSync, syncReq, &syncResp)
+	if err != nil {
+		return fmt.Errorf("failed to sync routes with client: %v", err)
+	}
+
+	if len(syncResp.Created)+len(syncResp.Updated)+len(syncResp.Withdrawn) > 0 {
+		fmt.Printf("Provision > Client %s: created %v, updated %v, withdrawn %v\n", e.name, syncResp.Created, syncResp.Updated, syncResp.Withdrawn)
+	}
+	for _, syncErr := range syncResp.Errors {
+		fmt.Printf("Provision > Client %s rejected %s\n", e.name, syncErr)
+	}
+	return nil
+}
@@ -1,98 +1,145 @@
 package ip
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-	"time"
+	"sync"
+	"tunnelled/internal/config"
+	"tunnelled/internal/control"
 	"tunnelled/internal/router"
 )
 
 type IPUpdateRequest struct {
-	Endpoints []string `json:"endpoints"`
+	Endpoints []string `json:"endpoints"` // legacy, client route IDs to point to the new IP
 	NewIP     string   `json:"new-ip"`
+
+	// Link model, the client updates the routes linked to these server routes
+	Server string        `json:"server,omitempty"`
+	Routes []RouteUpdate `json:"routes,omitempty"`
+}
+
+// RouteUpdate is a server route and the public port clients should dial for it
+type RouteUpdate struct {
+	Route string `json:"route"`
+	Port  int    `json:"port"`
 }
 
 type IPUpdateResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success bool     `json:"success"`
+	Message string   `json:"message"`
+	Updated []string `json:"updated,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+
+	Unlinked []string `json:"unlinked,omitempty"` // server routes no client route links to, left alone
+
+	Reachability []ReachabilityResult `json:"reachability,omitempty"` // dial-back probes of the updated routes
 }
 
-type IPNotifier struct {
-	routeManager   *router.Manager
-	clientEndpoint string
-	bearerToken    string
-	httpClient     *http.Client
+// RouteState is the backend of a client route, as returned by GET /api/ip/routes
+type RouteState struct {
+	RouteID     string            `json:"route_id"`
+	BackendIP   string            `json:"backend_ip"`
+	BackendPort int               `json:"backend_port"`
+	BackendHost string            `json:"backend_host,omitempty"`
+	Link        *router.RouteLink `json:"link,omitempty"`
 }
 
-func NewIPNotifier(routeManager *router.Manager, clientEndpoint, bearerToken string) *IPNotifier {
-	return &IPNotifier{
-		routeManager:   routeManager,
-		clientEndpoint: clientEndpoint,
-		bearerToken:    bearerToken,
-		httpClient: &http.Client{
-			Timeout: 15 * time.Second,
-		},
-	}
+type RouteStateResponse struct {
+	Routes []RouteState `json:"routes"`
 }
 
-// NotifyClientOfIPChange sends IP update to client with list of endpoints to update
-func (n *IPNotifier) NotifyClientOfIPChange(newIP string) error {
-	// Collect all route IDs from RouterManager
-	var endpoints []string
-	n.routeManager.Routes.Range(func(key, value any) bool {
-		route, ok := value.(*router.Route)
-		if ok {
-			endpoints = append(endpoints, route.RouteID)
-		}
-		return true
-	})
+// IPNotifier fans out IP changes to every tunnelled-client edge
+type IPNotifier struct {
+	routeManager *router.Manager
+	edges        []*ClientEdge
+}
 
-	if len(endpoints) == 0 {
-		return fmt.Errorf("no routes found to update")
+// NewIPNotifier creates a notifier for the configured client edges. defaultToken is used by edges
+// without their own token, including the legacy single client_endpoint.
+func NewIPNotifier(routeManager *router.Manager, serverConfig *config.ServerConfig, defaultToken string) (*IPNotifier, error) {
+	n := &IPNotifier{
+		routeManager: routeManager,
 	}
 
-	updateReq := IPUpdateRequest{
-		Endpoints: endpoints,
-		NewIP:     newIP,
+	clients := serverConfig.Clients
+	if len(clients) == 0 {
+		clients = []config.ClientEdgeConfig{{Name: "default", Endpoint: serverConfig.ClientEndpoint, Control: serverConfig.ClientControl}}
 	}
 
-	jsonData, err := json.Marshal(updateReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal IP update request: %v", err)
-	}
+	names := make(map[string]bool)
+	for i, clientConfig := range clients {
+		if clientConfig.Endpoint == "" && clientConfig.Control == "" {
+			return nil, fmt.Errorf("client #%d has no endpoint nor control address", i+1)
+		}
+		if clientConfig.Name == "" {
+			clientConfig.Name = clientConfig.Endpoint
+			if clientConfig.Name == "" {
+				clientConfig.Name = clientConfig.Control
+			}
+		}
+		if names[clientConfig.Name] {
+			return nil, fmt.Errorf("duplicate client name: %s", clientConfig.Name)
+		}
+		names[clientConfig.Name] = true
 
-	// Send to client with Bearer token
-	url := fmt.Sprintf("%s/api/ip/update", n.clientEndpoint)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		token := defaultToken
+		if clientConfig.Token != "" {
+			token = clientConfig.Token
+		}
+
+		n.edges = append(n.edges, newClientEdge(routeManager, serverConfig.Name, clientConfig, token, serverConfig.ReconcileInterval))
 	}
-	
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", n.bearerToken)
-	
-	resp, err := n.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send IP update to client: %v", err)
+
+	return n, nil
+}
+
+// SetIP schedules the delivery of a new public IP to every edge, it returns immediately
+func (n *IPNotifier) SetIP(ip string) {
+	for _, edge := range n.edges {
+		edge.SetIP(ip)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("client returned status %d for IP update", resp.StatusCode)
+// Run starts the delivery loop of every edge
+func (n *IPNotifier) Run() {
+	for _, edge := range n.edges {
+		go edge.Run()
 	}
+}
 
-	var updateResp IPUpdateResponse
-	err = json.NewDecoder(resp.Body).Decode(&updateResp)
-	if err != nil {
-		return fmt.Errorf("failed to decode client response: %v", err)
+// NotifyClientOfIPChange sends the IP update to every edge concurrently, waiting for all of them
+func (n *IPNotifier) NotifyClientOfIPChange(newIP string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(n.edges))
+	for i, edge := range n.edges {
+		wg.Add(1)
+		go func(i int, edge *ClientEdge) {
+			defer wg.Done()
+			errs[i] = edge.NotifyClientOfIPChange(newIP)
+		}(i, edge)
 	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
 
-	if !updateResp.Success {
-		return fmt.Errorf("client rejected IP update: %s", updateResp.Message)
+// Admin sends an admin command to the named client over its control channel
+func (n *IPNotifier) Admin(ctx context.Context, client string, command control.AdminCommand) (json.RawMessage, error) {
+	for _, edge := range n.edges {
+		if edge.name == client {
+			return edge.Admin(ctx, command)
+		}
 	}
+	return nil, fmt.Errorf("unknown client %s", client)
+}
 
-	fmt.Printf("Successfully notified client of IP change. Updated endpoints: %v -> %s\n", endpoints, newIP)
-	return nil
-}
\ No newline at end of file
+// Status returns the delivery state of every edge
+func (n *IPNotifier) Status() []EdgeStatus {
+	status := make([]EdgeStatus, 0, len(n.edges))
+	for _, edge := range n.edges {
+		status = append(status, edge.Status())
+	}
+	return status
+}
@@ -0,0 +1,259 @@
+package ip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+	"tunnelled/internal/config"
+)
+
+// Provider discovers the public IP of this machine from a single source
+type Provider interface {
+	Name() string
+	PublicIP(ctx context.Context) (string, error)
+}
+
+const defaultEchoURL = "https://checkip.amazonaws.com"
+
+// NewProviders builds the providers described in the configuration,
+// falling back to the plain HTTP echo of checkip.amazonaws.com when none are set.
+func NewProviders(cfg config.IPDiscoveryConfig) ([]Provider, error) {
+	if len(cfg.Providers) == 0 {
+		return []Provider{NewHTTPProvider([]string{defaultEchoURL})}, nil
+	}
+
+	providers := make([]Provider, 0, len(cfg.Providers))
+	for i, providerConfig := range cfg.Providers {
+		provider, err := newProvider(providerConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP provider #%d: %v", i+1, err)
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+func newProvider(cfg config.IPProviderConfig) (Provider, error) {
+	switch cfg.Type {
+	case "http":
+		if len(cfg.URLs) == 0 {
+			return nil, fmt.Errorf("http provider needs at least one url")
+		}
+		return NewHTTPProvider(cfg.URLs), nil
+	case "dns":
+		if cfg.Resolver == "" || cfg.Hostname == "" {
+			return nil, fmt.Errorf("dns provider needs a resolver and a hostname")
+		}
+		recordType := strings.ToUpper(cfg.RecordType)
+		if recordType == "" {
+			recordType = "A"
+		}
+		if recordType != "A" && recordType != "AAAA" && recordType != "TXT" {
+			return nil, fmt.Errorf("unsupported dns record type: %s", cfg.RecordType)
+		}
+		return &DNSProvider{Resolver: cfg.Resolver, Hostname: cfg.Hostname, RecordType: recordType}, nil
+	case "interface":
+		if cfg.Interface == "" {
+			return nil, fmt.Errorf("interface provider needs an interface name")
+		}
+		return &InterfaceProvider{Interface: cfg.Interface, IPv6: cfg.IPv6}, nil
+	case "stun":
+		return NewSTUNProvider(cfg.Servers), nil
+	case "command":
+		if len(cfg.Command) == 0 {
+			return nil, fmt.Errorf("command provider needs a command")
+		}
+		return &CommandProvider{Command: cfg.Command}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider type: %q", cfg.Type)
+	}
+}
+
+// parseIP validates a provider answer and normalizes its representation
+func parseIP(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address: %q", value)
+	}
+	return ip.String(), nil
+}
+
+// HTTPProvider asks plain-text echo services, trying each URL in order until one answers
+type HTTPProvider struct {
+	URLs       []string
+	httpClient *http.Client
+}
+
+// Timeout of a single URL when the caller sets no deadline
+const httpURLTimeout = 10 * time.Second
+
+func NewHTTPProvider(urls []string) *HTTPProvider {
+	return &HTTPProvider{
+		URLs:       urls,
+		httpClient: &http.Client{},
+	}
+}
+
+func (p *HTTPProvider) Name() string {
+	return "http"
+}
+
+func (p *HTTPProvider) PublicIP(ctx context.Context) (string, error) {
+	var lastErr error
+	for i, url := range p.URLs {
+		// The time left is shared between the remaining URLs, so a hanging one doesn't starve the others
+		timeout := httpURLTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline) / time.Duration(len(p.URLs)-i)
+		}
+		urlCtx, cancel := context.WithTimeout(ctx, timeout)
+		ip, err := p.fetch(urlCtx, url)
+		cancel()
+		if err == nil {
+			return ip, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+func (p *HTTPProvider) fetch(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch public IP from %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	return parseIP(string(body))
+}
+
+// DNSProvider queries a resolver that answers with the address of the asker,
+// like myip.opendns.com A @resolver1.opendns.com or o-o.myaddr.l.google.com TXT @ns1.google.com
+type DNSProvider struct {
+	Resolver   string // host:port, port 53 if omitted
+	Hostname   string
+	RecordType string // A, AAAA or TXT
+}
+
+func (p *DNSProvider) Name() string {
+	return "dns"
+}
+
+func (p *DNSProvider) PublicIP(ctx context.Context) (string, error) {
+	resolver := newResolver(p.Resolver)
+
+	switch p.RecordType {
+	case "TXT":
+		records, err := resolver.LookupTXT(ctx, p.Hostname)
+		if err != nil {
+			return "", fmt.Errorf("TXT lookup of %s failed: %v", p.Hostname, err)
+		}
+		for _, record := range records {
+			if ip, err := parseIP(record); err == nil {
+				return ip, nil
+			}
+		}
+		return "", fmt.Errorf("no IP address in TXT records of %s", p.Hostname)
+	default:
+		network := "ip4"
+		if p.RecordType == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, network, p.Hostname)
+		if err != nil {
+			return "", fmt.Errorf("%s lookup of %s failed: %v", p.RecordType, p.Hostname, err)
+		}
+		if len(ips) == 0 {
+			return "", fmt.Errorf("no %s records for %s", p.RecordType, p.Hostname)
+		}
+		return ips[0].String(), nil
+	}
+}
+
+// newResolver returns a resolver sending every query to the given server instead of the system ones
+func newResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// InterfaceProvider reads the first global unicast address of a local interface,
+// for machines where the public IP is assigned directly (PPPoE, bridged modems...)
+type InterfaceProvider struct {
+	Interface string
+	IPv6      bool
+}
+
+func (p *InterfaceProvider) Name() string {
+	return "interface"
+}
+
+func (p *InterfaceProvider) PublicIP(_ context.Context) (string, error) {
+	iface, err := net.InterfaceByName(p.Interface)
+	if err != nil {
+		return "", fmt.Errorf("failed to find interface %s: %v", p.Interface, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to read addresses of %s: %v", p.Interface, err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+		if (ipNet.IP.To4() == nil) != p.IPv6 {
+			continue
+		}
+		return ipNet.IP.String(), nil
+	}
+
+	return "", fmt.Errorf("no public address on interface %s", p.Interface)
+}
+
+// CommandProvider runs an external command and reads the IP from its standard output
+type CommandProvider struct {
+	Command []string
+}
+
+func (p *CommandProvider) Name() string {
+	return "command"
+}
+
+func (p *CommandProvider) PublicIP(ctx context.Context) (string, error) {
+	output, err := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("command %s failed: %v", p.Command[0], err)
+	}
+	return parseIP(string(output))
+}
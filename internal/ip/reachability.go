@@ -0,0 +1,73 @@
+package ip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"tunnelled/internal/net"
+	"tunnelled/internal/router"
+)
+
+const probeTimeout = 5 * time.Second
+
+// ReachabilityResult is the outcome of a dial-back probe from the client to the backend of a route
+type ReachabilityResult struct {
+	RouteID   string  `json:"route_id"`
+	Address   string  `json:"address"`
+	Reachable bool    `json:"reachable"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// CheckReachability probes the backend of every route concurrently
+func CheckReachability(routes []*router.Route) []ReachabilityResult {
+	results := make([]ReachabilityResult, len(routes))
+
+	var wg sync.WaitGroup
+	for i, route := range routes {
+		wg.Add(1)
+		go func(i int, route *router.Route) {
+			defer wg.Done()
+
+			backendIP, backendPort := route.Backend()
+			address := fmt.Sprintf("%s:%d", backendIP, backendPort)
+			ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+			defer cancel()
+
+			result := ReachabilityResult{RouteID: route.RouteID, Address: address}
+			latency, err := net.Probe(ctx, address)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Reachable = true
+				result.LatencyMS = float64(latency.Microseconds()) / 1000
+			}
+			results[i] = result
+		}(i, route)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// RoutesToProbe returns the route with the given ID, or every route if routeID is empty
+func RoutesToProbe(manager *router.Manager, routeID string) ([]*router.Route, error) {
+	if routeID != "" {
+		route, ok := manager.GetRoute(routeID)
+		if !ok {
+			return nil, fmt.Errorf("route %s not found", routeID)
+		}
+		return []*router.Route{route}, nil
+	}
+
+	var routes []*router.Route
+	manager.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*router.Route)
+		if ok {
+			routes = append(routes, route)
+		}
+		return true
+	})
+	return routes, nil
+}
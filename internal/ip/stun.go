@@ -0,0 +1,373 @@
+package ip
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// STUN (RFC 5389) message constants
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunBindingError    = 0x0111
+	stunMagicCookie     = 0x2112A442
+	stunHeaderSize      = 20
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+	stunAttrOtherAddress     = 0x802C // RFC 5780
+)
+
+var defaultSTUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+
+// cgnatRange is the shared address space used by carrier-grade NAT (RFC 6598)
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+type NATType string
+
+const (
+	NATUnknown             NATType = "unknown"
+	NATOpen                NATType = "open"                 // no NAT, the public IP is on a local interface
+	NATEndpointIndependent NATType = "endpoint_independent" // same mapping for every destination (full/restricted cone)
+	NATAddressDependent    NATType = "address_dependent"    // mapping changes per destination (symmetric)
+)
+
+// STUNResult is the answer of a single Binding request
+type STUNResult struct {
+	MappedIP     net.IP
+	MappedPort   int
+	OtherAddress *net.UDPAddr // alternate server address, only sent by RFC 5780 servers
+}
+
+// NATReport describes how the home connection is seen from the internet
+type NATReport struct {
+	Type          NATType   `json:"type"`
+	PublicIP      string    `json:"public_ip"`
+	LocalIP       string    `json:"local_ip"`
+	LocalPort     int       `json:"local_port"`
+	MappedPort    int       `json:"mapped_port"`
+	PortPreserved bool      `json:"port_preserved"`
+	WANIP         string    `json:"wan_ip,omitempty"` // external address reported by the router, if port mapping is enabled
+	CGNAT         bool      `json:"cgnat"`
+	CheckedAt     time.Time `json:"checked_at"`
+}
+
+// STUNProvider discovers the public IP with Binding requests, servers are tried in order
+type STUNProvider struct {
+	Servers []string
+	Timeout time.Duration
+}
+
+func NewSTUNProvider(servers []string) *STUNProvider {
+	if len(servers) == 0 {
+		servers = defaultSTUNServers
+	}
+	return &STUNProvider{
+		Servers: servers,
+		Timeout: 3 * time.Second,
+	}
+}
+
+func (p *STUNProvider) Name() string {
+	return "stun"
+}
+
+func (p *STUNProvider) PublicIP(ctx context.Context) (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open UDP socket: %v", err)
+	}
+	defer conn.Close()
+
+	var errs []error
+	for _, server := range p.Servers {
+		result, err := p.bind(ctx, conn, server)
+		if err == nil {
+			return result.MappedIP.String(), nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+// ClassifyNAT runs the RFC 5780 mapping behaviour test: the same local socket asks two different
+// servers for its mapping, a NAT reusing the mapping for both is endpoint independent.
+func (p *STUNProvider) ClassifyNAT(ctx context.Context) (*NATReport, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %v", err)
+	}
+	defer conn.Close()
+
+	report := &NATReport{
+		Type:      NATUnknown,
+		LocalPort: conn.LocalAddr().(*net.UDPAddr).Port,
+		CheckedAt: time.Now(),
+	}
+
+	var first *STUNResult
+	var firstServer string
+	var errs []error
+	for _, server := range p.Servers {
+		first, err = p.bind(ctx, conn, server)
+		if err == nil {
+			firstServer = server
+			break
+		}
+		errs = append(errs, err)
+	}
+	if first == nil {
+		return nil, errors.Join(errs...)
+	}
+
+	report.PublicIP = first.MappedIP.String()
+	report.MappedPort = first.MappedPort
+	report.PortPreserved = first.MappedPort == report.LocalPort
+	if localIP := outboundIP(firstServer); localIP != nil {
+		report.LocalIP = localIP.String()
+	}
+	// A local interface in the shared space means this machine is directly behind the carrier NAT,
+	// the router's WAN address is checked by the discovery service when it's known
+	report.CGNAT = hasSharedAddress()
+
+	if isLocalIP(first.MappedIP) {
+		report.Type = NATOpen
+		return report, nil
+	}
+
+	// Prefer the alternate address announced by the server, otherwise use another server of the list
+	var secondTargets []string
+	if first.OtherAddress != nil {
+		secondTargets = append(secondTargets, first.OtherAddress.String())
+	}
+	for _, server := range p.Servers {
+		if server != firstServer {
+			secondTargets = append(secondTargets, server)
+		}
+	}
+
+	for _, server := range secondTargets {
+		second, err := p.bind(ctx, conn, server)
+		if err != nil {
+			continue
+		}
+		if second.MappedIP.Equal(first.MappedIP) && second.MappedPort == first.MappedPort {
+			report.Type = NATEndpointIndependent
+		} else {
+			report.Type = NATAddressDependent
+		}
+		break
+	}
+
+	return report, nil
+}
+
+// bind sends a Binding request to the server, retransmitting it until the timeout (RFC 5389 7.2.1)
+func (p *STUNProvider) bind(ctx context.Context, conn *net.UDPConn, server string) (*STUNResult, error) {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server %s: %v", server, err)
+	}
+
+	transactionID := make([]byte, 12)
+	_, _ = rand.Read(transactionID)
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	copy(request[8:20], transactionID)
+
+	deadline := time.Now().Add(p.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	buf := make([]byte, 1500)
+	rto := 500 * time.Millisecond
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteToUDP(request, addr); err != nil {
+			return nil, fmt.Errorf("failed to send STUN request to %s: %v", server, err)
+		}
+
+		readDeadline := time.Now().Add(rto)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		_ = conn.SetReadDeadline(readDeadline)
+
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break // timed out, retransmit
+			}
+			if !from.IP.Equal(addr.IP) || from.Port != addr.Port {
+				continue
+			}
+
+			result, err := parseSTUNResponse(buf[:n], transactionID)
+			if err != nil {
+				return nil, fmt.Errorf("invalid STUN response from %s: %v", server, err)
+			}
+			if result == nil {
+				continue // another transaction
+			}
+			return result, nil
+		}
+		rto *= 2
+	}
+
+	return nil, fmt.Errorf("STUN request to %s timed out", server)
+}
+
+// parseSTUNResponse decodes a Binding response, returning nil if it belongs to another transaction
+func parseSTUNResponse(data []byte, transactionID []byte) (*STUNResult, error) {
+	if len(data) < stunHeaderSize {
+		return nil, fmt.Errorf("message too short")
+	}
+	if binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie {
+		return nil, fmt.Errorf("invalid magic cookie")
+	}
+	if !bytes.Equal(data[8:20], transactionID) {
+		return nil, nil
+	}
+
+	messageType := binary.BigEndian.Uint16(data[0:2])
+	if messageType == stunBindingError {
+		return nil, fmt.Errorf("server returned a binding error")
+	}
+	if messageType != stunBindingResponse {
+		return nil, fmt.Errorf("unexpected message type 0x%04x", messageType)
+	}
+
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) < stunHeaderSize+length {
+		return nil, fmt.Errorf("truncated message")
+	}
+
+	result := &STUNResult{}
+	var mappedIP net.IP
+	var mappedPort int
+	attributes := data[stunHeaderSize : stunHeaderSize+length]
+	for len(attributes) >= 4 {
+		attrType := binary.BigEndian.Uint16(attributes[0:2])
+		attrLength := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if len(attributes) < 4+attrLength {
+			return nil, fmt.Errorf("truncated attribute 0x%04x", attrType)
+		}
+		value := attributes[4 : 4+attrLength]
+
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			ip, port, err := parseSTUNAddress(value, data[4:20])
+			if err != nil {
+				return nil, err
+			}
+			result.MappedIP, result.MappedPort = ip, port
+		case stunAttrMappedAddress:
+			ip, port, err := parseSTUNAddress(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			mappedIP, mappedPort = ip, port
+		case stunAttrOtherAddress:
+			ip, port, err := parseSTUNAddress(value, nil)
+			if err == nil {
+				result.OtherAddress = &net.UDPAddr{IP: ip, Port: port}
+			}
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		padded := (attrLength + 3) &^ 3
+		if len(attributes) < 4+padded {
+			break
+		}
+		attributes = attributes[4+padded:]
+	}
+
+	// Old servers only send MAPPED-ADDRESS
+	if result.MappedIP == nil {
+		result.MappedIP, result.MappedPort = mappedIP, mappedPort
+	}
+	if result.MappedIP == nil {
+		return nil, fmt.Errorf("no mapped address in response")
+	}
+	return result, nil
+}
+
+// parseSTUNAddress decodes a (XOR-)MAPPED-ADDRESS value, xorKey is the cookie + transaction ID for XOR addresses
+func parseSTUNAddress(value []byte, xorKey []byte) (net.IP, int, error) {
+	if len(value) < 4 {
+		return nil, 0, fmt.Errorf("address attribute too short")
+	}
+
+	family := value[1]
+	port := binary.BigEndian.Uint16(value[2:4])
+	var ip net.IP
+	switch family {
+	case 0x01:
+		if len(value) < 8 {
+			return nil, 0, fmt.Errorf("IPv4 address attribute too short")
+		}
+		ip = make(net.IP, 4)
+		copy(ip, value[4:8])
+	case 0x02:
+		if len(value) < 20 {
+			return nil, 0, fmt.Errorf("IPv6 address attribute too short")
+		}
+		ip = make(net.IP, 16)
+		copy(ip, value[4:20])
+	default:
+		return nil, 0, fmt.Errorf("unknown address family %d", family)
+	}
+
+	if xorKey != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+
+	return ip, int(port), nil
+}
+
+// outboundIP returns the local address used to reach the server
+func outboundIP(server string) net.IP {
+	conn, err := net.Dial("udp4", server)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSharedAddress reports if a local interface sits in the CGNAT shared address space
+func hasSharedAddress() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && cgnatRange.Contains(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"tunnelled/internal/router"
+)
+
+// ApplyUpdate applies an IP update received from a server to the client routes.
+// When the server names itself and routes are linked to it, the update goes through the links
+// and any mismatch is an error. Otherwise, the legacy endpoints list is used.
+func ApplyUpdate(manager *router.Manager, updateReq IPUpdateRequest) (*IPUpdateResponse, error) {
+	var updated, unlinked []string
+	var errs []error
+	var targets []*router.Route // routes addressed by the update, probed afterwards
+
+	if updateReq.Server != "" && len(manager.LinkedRoutes(updateReq.Server)) > 0 {
+		serverRoutes := make(map[string]int, len(updateReq.Routes))
+		for _, route := range updateReq.Routes {
+			serverRoutes[route.Route] = route.Port
+		}
+		updated, unlinked, errs = manager.ApplyLinkedUpdate(updateReq.Server, updateReq.NewIP, serverRoutes)
+
+		for _, route := range manager.LinkedRoutes(updateReq.Server) {
+			if _, ok := serverRoutes[route.Link.Route]; ok {
+				targets = append(targets, route)
+			}
+		}
+	} else {
+		for _, routeID := range updateReq.Endpoints {
+			route, ok := manager.GetRoute(routeID)
+			if !ok {
+				fmt.Printf("Warning: route %s not found\n", routeID)
+				continue
+			}
+			targets = append(targets, route)
+			if manager.UpdateBackend(route, updateReq.NewIP, 0) {
+				updated = append(updated, routeID)
+			}
+		}
+	}
+
+	// Save updated routes to file
+	if len(updated) > 0 {
+		err := manager.SaveRoutesToFile()
+		if err != nil {
+			return nil, fmt.Errorf("failed to save routes: %v", err)
+		}
+	}
+
+	resp := &IPUpdateResponse{
+		Success:  len(errs) == 0,
+		Message:  fmt.Sprintf("updated %d routes", len(updated)),
+		Updated:  updated,
+		Unlinked: unlinked,
+	}
+
+	// Dial back the new address, so the server learns whether we can actually reach it
+	resp.Reachability = CheckReachability(targets)
+	for _, result := range resp.Reachability {
+		if !result.Reachable {
+			fmt.Printf("Route %s can't reach %s: %s\n", result.RouteID, result.Address, result.Error)
+		}
+	}
+
+	for _, err := range errs {
+		fmt.Printf("IP update from %s: %v\n", updateReq.Server, err)
+		resp.Errors = append(resp.Errors, err.Error())
+	}
+	if len(errs) > 0 {
+		resp.Message = fmt.Sprintf("updated %d routes, %v", len(updated), errors.Join(errs...))
+	}
+	return resp, nil
+}
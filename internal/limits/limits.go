@@ -0,0 +1,155 @@
+package limits
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"tunnelled/internal/metrics"
+	"tunnelled/internal/router"
+)
+
+// Refusal is returned by Admit when a connection is over a limit
+type Refusal struct {
+	Metric string // counter incremented for the refused connection
+	Reason string
+}
+
+func (r *Refusal) Error() string {
+	return r.Reason
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last connection, up to the capacity
+func (b *bucket) refill(limit *router.RateLimit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if capacity := limit.Capacity(); b.tokens > capacity {
+		b.tokens = capacity
+	}
+	b.last = now
+}
+
+// How long an unused bucket is kept, it's full again long before that with any sane rate
+const bucketIdleTime = 10 * time.Minute
+
+// Token buckets by key ("route|ip|<ip>", "route|prefix|<prefix>" or "route"), and live connections counted against the caps
+var (
+	buckets     = make(map[string]*bucket)
+	active      = make(map[string]int) // "route" or "route|ip|<ip>" -> live connections
+	lastPrune   time.Time
+	limitsMutex sync.Mutex
+)
+
+// Admit takes a new connection of a route from ip through the limits of the route.
+// The returned function must be called once the connection is closed, to free its place under the caps.
+func Admit(routeID string, limits *router.Limits, ip net.IP) (func(), error) {
+	if limits == nil {
+		return func() {}, nil
+	}
+
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(lastPrune) > time.Minute {
+		pruneLocked(now)
+	}
+
+	ipKey := routeID + "|ip|" + ip.String()
+	if limits.MaxConnections > 0 && active[routeID] >= limits.MaxConnections {
+		return nil, &Refusal{
+			Metric: metrics.ConnectionCapRoute,
+			Reason: fmt.Sprintf("route %s is at its cap of %d connections", routeID, limits.MaxConnections),
+		}
+	}
+	if limits.MaxConnectionsPerIP > 0 && ip != nil && active[ipKey] >= limits.MaxConnectionsPerIP {
+		return nil, &Refusal{
+			Metric: metrics.ConnectionCapIP,
+			Reason: fmt.Sprintf("%s is at its cap of %d connections", ip, limits.MaxConnectionsPerIP),
+		}
+	}
+
+	// Every bucket must have a token before any is taken, refused connections cost nothing
+	type check struct {
+		key    string
+		limit  *router.RateLimit
+		metric string
+		reason string
+	}
+	checks := []check{{routeID, limits.PerRoute, metrics.RateLimitedRoute, fmt.Sprintf("too many new connections on route %s", routeID)}}
+	if ip != nil {
+		prefix := Prefix(ip)
+		checks = append(checks,
+			check{routeID + "|prefix|" + prefix.String(), limits.PerPrefix, metrics.RateLimitedPrefix, fmt.Sprintf("too many new connections from %s", prefix)},
+			check{ipKey, limits.PerIP, metrics.RateLimitedIP, fmt.Sprintf("too many new connections from %s", ip)},
+		)
+	}
+
+	var taken []*bucket
+	for _, c := range checks {
+		if c.limit == nil {
+			continue
+		}
+		b, ok := buckets[c.key]
+		if !ok {
+			b = &bucket{tokens: c.limit.Capacity(), last: now}
+			buckets[c.key] = b
+		}
+		b.refill(c.limit, now)
+		if b.tokens < 1 {
+			return nil, &Refusal{Metric: c.metric, Reason: c.reason}
+		}
+		taken = append(taken, b)
+	}
+	for _, b := range taken {
+		b.tokens--
+	}
+
+	active[routeID]++
+	if ip != nil {
+		active[ipKey]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limitsMutex.Lock()
+			defer limitsMutex.Unlock()
+			release(routeID)
+			if ip != nil {
+				release(ipKey)
+			}
+		})
+	}, nil
+}
+
+func release(key string) {
+	active[key]--
+	if active[key] <= 0 {
+		delete(active, key)
+	}
+}
+
+// pruneLocked drops the buckets unused for a while, so floods from many IPs don't grow the map forever
+func pruneLocked(now time.Time) {
+	for key, b := range buckets {
+		if now.Sub(b.last) > bucketIdleTime {
+			delete(buckets, key)
+		}
+	}
+	lastPrune = now
+}
+
+// Prefix returns the /24 of an IPv4 address or the /64 of an IPv6 one, the usual allocation of a single host
+func Prefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(64, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import "sync"
+
+// Counter names
+const (
+	ProxyHeaderRejected = "proxy_header_rejected" // PROXY header sent by an untrusted peer
+	ProxyHeaderInvalid  = "proxy_header_invalid"  // malformed, too long, missing or of a refused version
+	ProxyHeaderTimeout  = "proxy_header_timeout"  // not received in time
+	ACLDenied           = "acl_denied"            // player IP denied by the route ACL
+	BanRefused          = "ban_refused"           // connection of a banned IP
+	RateLimitedIP       = "rate_limited_ip"       // too many new connections from an IP
+	RateLimitedPrefix   = "rate_limited_prefix"   // too many new connections from a /24 or /64
+	RateLimitedRoute    = "rate_limited_route"    // too many new connections on the route
+	ConnectionCapRoute  = "connection_cap_route"  // the route is at its concurrent connection cap
+	ConnectionCapIP     = "connection_cap_ip"     // the IP is at its concurrent connection cap
+	AutoBanned          = "auto_banned"           // IP banned after repeated protocol errors
+	EventDropped        = "event_dropped"         // event missed by a subscriber too slow to keep up
+	WebhookDropped      = "webhook_dropped"       // event not delivered because the webhook queue was full
+)
+
+// Counters of notable events per route, exposed on GET /api/metrics
+var (
+	counters      = make(map[string]map[string]uint64) // name -> route ID -> count
+	countersMutex sync.Mutex
+)
+
+// Inc increments a counter of a route
+func Inc(name, routeID string) {
+	Add(name, routeID, 1)
+}
+
+func Add(name, routeID string, delta uint64) {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	routes, ok := counters[name]
+	if !ok {
+		routes = make(map[string]uint64)
+		counters[name] = routes
+	}
+	routes[routeID] += delta
+}
+
+// Snapshot returns a copy of every counter
+func Snapshot() map[string]map[string]uint64 {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	snapshot := make(map[string]map[string]uint64, len(counters))
+	for name, routes := range counters {
+		copied := make(map[string]uint64, len(routes))
+		for routeID, count := range routes {
+			copied[routeID] = count
+		}
+		snapshot[name] = copied
+	}
+	return snapshot
+}
@@ -0,0 +1,153 @@
+package minecraft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Handshake states as sent in the "next state" field of the handshake packet
+const (
+	StateStatus   = 1
+	StateLogin    = 2
+	StateTransfer = 3
+)
+
+// ErrIncomplete is returned when more data is needed to decode a packet
+var ErrIncomplete = errors.New("incomplete minecraft packet")
+
+// ErrLegacyPing is returned for the server list pings of pre-1.7 clients, which aren't handshakes
+var ErrLegacyPing = errors.New("legacy server list ping is not supported")
+
+type Handshake struct {
+	ProtocolVersion int32
+	ServerAddress   string
+	ServerPort      uint16
+	NextState       int32
+}
+
+// IsLogin reports whether the client is heading into the login state,
+// the only state where we can safely inject a disconnect packet.
+func (h *Handshake) IsLogin() bool {
+	return h.NextState == StateLogin || h.NextState == StateTransfer
+}
+
+// ParseHandshake decodes the serverbound handshake packet (id 0x00) at the start of data.
+// Legacy (pre-1.7) server list pings are reported as an error.
+func ParseHandshake(data []byte) (*Handshake, int, error) {
+	if len(data) > 0 && data[0] == 0xFE {
+		return nil, 0, ErrLegacyPing
+	}
+
+	length, n, err := ReadVarInt(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if length <= 0 || length > 1024 {
+		return nil, 0, fmt.Errorf("invalid handshake length: %d", length)
+	}
+
+	total := n + int(length)
+	if len(data) < total {
+		return nil, 0, ErrIncomplete
+	}
+	packet := data[n:total]
+
+	packetID, n, err := ReadVarInt(packet)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid handshake packet id: %v", err)
+	}
+	if packetID != 0x00 {
+		return nil, 0, fmt.Errorf("unexpected handshake packet id: %d", packetID)
+	}
+	packet = packet[n:]
+
+	protocolVersion, n, err := ReadVarInt(packet)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid protocol version: %v", err)
+	}
+	packet = packet[n:]
+
+	address, n, err := readString(packet, 255)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid server address: %v", err)
+	}
+	packet = packet[n:]
+
+	if len(packet) < 2 {
+		return nil, 0, fmt.Errorf("missing server port")
+	}
+	port := binary.BigEndian.Uint16(packet[:2])
+	packet = packet[2:]
+
+	nextState, n, err := ReadVarInt(packet)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid next state: %v", err)
+	}
+	if nextState < StateStatus || nextState > StateTransfer {
+		return nil, 0, fmt.Errorf("invalid next state: %d", nextState)
+	}
+	if len(packet) != n {
+		return nil, 0, fmt.Errorf("trailing data in handshake packet")
+	}
+
+	return &Handshake{
+		ProtocolVersion: protocolVersion,
+		ServerAddress:   address,
+		ServerPort:      port,
+		NextState:       nextState,
+	}, total, nil
+}
+
+// LoginDisconnect builds a clientbound login Disconnect packet (id 0x00) with the given reason
+func LoginDisconnect(reason string) []byte {
+	text, _ := json.Marshal(map[string]string{"text": reason})
+
+	payload := AppendVarInt(nil, 0x00)
+	payload = AppendVarInt(payload, int32(len(text)))
+	payload = append(payload, text...)
+
+	packet := AppendVarInt(nil, int32(len(payload)))
+	return append(packet, payload...)
+}
+
+// ReadVarInt decodes a protocol VarInt, returning the value and the bytes consumed
+func ReadVarInt(data []byte) (int32, int, error) {
+	var value uint32
+	for i := 0; i < 5; i++ {
+		if i >= len(data) {
+			return 0, 0, ErrIncomplete
+		}
+		b := data[i]
+		value |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(value), i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("varint is too big")
+}
+
+// AppendVarInt appends the VarInt encoding of value to buf
+func AppendVarInt(buf []byte, value int32) []byte {
+	v := uint32(value)
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func readString(data []byte, maxLength int) (string, int, error) {
+	length, n, err := ReadVarInt(data)
+	if err != nil {
+		return "", 0, err
+	}
+	if length < 0 || int(length) > maxLength*4 {
+		return "", 0, fmt.Errorf("string length out of range: %d", length)
+	}
+	if len(data) < n+int(length) {
+		return "", 0, ErrIncomplete
+	}
+	return string(data[n : n+int(length)]), n + int(length), nil
+}
@@ -2,14 +2,22 @@ package net
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"tunnelled/internal/bans"
+	"tunnelled/internal/events"
 	"tunnelled/internal/haproxy"
+	"tunnelled/internal/metrics"
+	"tunnelled/internal/minecraft"
+	"tunnelled/internal/router"
 
 	"github.com/panjf2000/gnet/v2"
 )
@@ -19,16 +27,38 @@ type Connection struct {
 
 	FirstPacketSent bool
 	ConnectionID    string // Unique ID for this connection
+	CreatedAt       time.Time
+
+	// Traffic counters, BytesIn is player -> backend and BytesOut is backend -> player
+	BytesIn  atomic.Uint64
+	BytesOut atomic.Uint64
+
+	// Minecraft handshake, used to decide if we can send a disconnect message
+	Handshake          *minecraft.Handshake
+	HandshakeInspected bool
+	handshakeBuffer    []byte // start of a handshake split over several reads
 
 	ClientConn  gnet.Conn
 	BackendConn gnet.Conn
 
 	// HAProxy protocol support
-	ProxyInfo         *haproxy.ProxyInfo
-	HAProxyProcessed  bool
-	PendingData       []byte
-
-	// Reconnection logic
+	ProxyInfo        *haproxy.ProxyInfo
+	HAProxyProcessed atomic.Bool // read by the header deadline outside of the event loop
+	PendingData      []byte
+	headerTimer      *time.Timer
+	headerExpired    atomic.Pointer[string] // why the header deadline closed the connection, see StartHeaderDeadline
+
+	// CloseReason is why we closed the connection ourselves, reported once it's closed
+	CloseReason string
+
+	// Route limits, releaseLimits frees the place of the connection under the caps.
+	// A refused player is kept until its handshake to receive Refusal as disconnect message.
+	releaseLimits func()
+	Refusal       string
+
+	// Reconnection logic. stateMutex guards the backend connection, the reconnect and migration state
+	// and the tunnel counters, they're changed from the player, backend and migration goroutines.
+	stateMutex        sync.Mutex
 	IsConnected       bool
 	PacketQueue       [][]byte
 	QueueMutex        sync.RWMutex
@@ -36,6 +66,18 @@ type Connection struct {
 	LastReconnectTime time.Time
 	MaxReconnectDelay time.Duration
 	MaxQueueSize      int
+	QueueOverflowed   bool // set once the queue starts dropping packets, cleared when flushed
+
+	// Migration to a new backend, see Migrate. The client waits for the server to take the session
+	// over on the new tunnel, the server waits for the old tunnel to deliver what the client sent on it.
+	Migrating     bool
+	handover      *handover      // client: migration in progress
+	pendingTunnel *pendingTunnel // server: new tunnel waiting to take the session over
+	reconnectWake chan struct{}
+
+	// Payload bytes sent and received on the current tunnel, so both ends of a handover know when the old one is drained
+	tunnelSent     uint64
+	tunnelReceived uint64
 }
 
 func NewConnection(listener *Listener, clientConn gnet.Conn) *Connection {
@@ -43,15 +85,67 @@ func NewConnection(listener *Listener, clientConn gnet.Conn) *Connection {
 		Listener:          listener,
 		ClientConn:        clientConn,
 		ConnectionID:      generateConnectionID(),
+		CreatedAt:         time.Now(),
 		IsConnected:       false,
 		PacketQueue:       make([][]byte, 0),
 		MaxReconnectDelay: 30 * time.Second,
 		MaxQueueSize:      1000,
-		HAProxyProcessed:  false,
 		PendingData:       make([]byte, 0),
+		reconnectWake:     make(chan struct{}, 1),
 	}
 }
 
+// ConnectionInfo is a point-in-time snapshot of a Connection, used by the admin API
+type ConnectionInfo struct {
+	ConnectionID      string    `json:"connection_id"`
+	RouteID           string    `json:"route_id"`
+	SourceIP          string    `json:"source_ip"`
+	CreatedAt         time.Time `json:"created_at"`
+	UptimeSeconds     int64     `json:"uptime_seconds"`
+	BytesIn           uint64    `json:"bytes_in"`
+	BytesOut          uint64    `json:"bytes_out"`
+	Connected         bool      `json:"connected"`
+	QueuedPackets     int       `json:"queued_packets"`
+	ReconnectAttempts int       `json:"reconnect_attempts"`
+}
+
+func (c *Connection) Info() ConnectionInfo {
+	info := ConnectionInfo{
+		ConnectionID:  c.ConnectionID,
+		RouteID:       c.Listener.Route.RouteID,
+		CreatedAt:     c.CreatedAt,
+		UptimeSeconds: int64(time.Since(c.CreatedAt).Seconds()),
+		BytesIn:       c.BytesIn.Load(),
+		BytesOut:      c.BytesOut.Load(),
+		QueuedPackets: c.QueueLength(),
+	}
+	c.stateMutex.Lock()
+	info.Connected = c.IsConnected
+	info.ReconnectAttempts = c.ReconnectAttempts
+	c.stateMutex.Unlock()
+	if ip := c.SourceIP(); ip != nil {
+		info.SourceIP = ip.String()
+	}
+	return info
+}
+
+// publish emits an event about this connection, including the effective source IP
+func (c *Connection) publish(eventType events.Type, data map[string]any) {
+	if data == nil {
+		data = make(map[string]any)
+	}
+	if ip := c.SourceIP(); ip != nil {
+		data["source_ip"] = ip.String()
+	}
+
+	events.Publish(events.Event{
+		Type:         eventType,
+		RouteID:      c.Listener.Route.RouteID,
+		ConnectionID: c.ConnectionID,
+		Data:         data,
+	})
+}
+
 func generateConnectionID() string {
 	bytes := make([]byte, 16)
 	rand.Read(bytes)
@@ -64,6 +158,10 @@ func (c *Connection) QueuePacket(data []byte) {
 
 	if len(c.PacketQueue) >= c.MaxQueueSize {
 		c.PacketQueue = c.PacketQueue[1:]
+		if !c.QueueOverflowed {
+			c.QueueOverflowed = true
+			c.publish(events.QueueOverflow, map[string]any{"max_queue_size": c.MaxQueueSize})
+		}
 	}
 
 	dataCopy := make([]byte, len(data))
@@ -71,10 +169,147 @@ func (c *Connection) QueuePacket(data []byte) {
 	c.PacketQueue = append(c.PacketQueue, dataCopy)
 }
 
+// QueueLength returns the amount of packets waiting for the backend
+func (c *Connection) QueueLength() int {
+	c.QueueMutex.RLock()
+	defer c.QueueMutex.RUnlock()
+	return len(c.PacketQueue)
+}
+
+// SourceIP returns the effective player IP, preferring the one received through HAProxy or the tunnel
+func (c *Connection) SourceIP() net.IP {
+	if c.ProxyInfo != nil && c.ProxyInfo.SrcIP != nil {
+		return c.ProxyInfo.SrcIP
+	}
+	return c.peerIP()
+}
+
+// maxHandshakeLength is how much player payload is buffered to find a handshake split over several reads
+const maxHandshakeLength = 2048
+
+// InspectHandshake looks at the first player payload to find out the Minecraft handshake state.
+// A handshake split over several reads is buffered until complete, then the connection is inspected
+// once and for all. The data is never modified. The error is nil for legacy pings, which aren't
+// the player's fault.
+func (c *Connection) InspectHandshake(data []byte) error {
+	if c.HandshakeInspected {
+		return nil
+	}
+
+	c.handshakeBuffer = append(c.handshakeBuffer, data...)
+	handshake, _, err := minecraft.ParseHandshake(c.handshakeBuffer)
+	if errors.Is(err, minecraft.ErrIncomplete) && len(c.handshakeBuffer) < maxHandshakeLength {
+		return nil
+	}
+	c.HandshakeInspected = true
+	c.handshakeBuffer = nil
+
+	if err != nil {
+		if errors.Is(err, minecraft.ErrLegacyPing) {
+			return nil
+		}
+		return err
+	}
+	c.Handshake = handshake
+	return nil
+}
+
+// CanSendDisconnect reports if a Minecraft disconnect packet would still be understood by the player.
+// This is only the case during login and before the backend has sent anything (encryption, compression...).
+func (c *Connection) CanSendDisconnect() bool {
+	return c.Handshake != nil && c.Handshake.IsLogin() && c.BytesOut.Load() == 0
+}
+
+// Kick closes the player connection, sending a Minecraft disconnect message first when possible
+func (c *Connection) Kick(reason string) error {
+	clientConn := c.ClientConn
+	if clientConn == nil {
+		return fmt.Errorf("connection %s has no client connection", c.ConnectionID)
+	}
+
+	if reason != "" && c.CanSendDisconnect() {
+		return clientConn.AsyncWrite(minecraft.LoginDisconnect(reason), func(conn gnet.Conn, err error) error {
+			return conn.Close()
+		})
+	}
+
+	return clientConn.Close()
+}
+
+// Refused players waiting for their handshake to receive the refusal as disconnect message. A flood must not
+// pile them up, they're kept for refusalTimeout at most and only maxPendingRefusals at once, every other refused
+// connection is closed right away. A single sweeper closes the late ones while there are any.
+const (
+	refusalTimeout     = time.Second
+	maxPendingRefusals = 256
+)
+
+var (
+	pendingRefusals      = make(map[*Connection]time.Time) // connection -> deadline
+	pendingRefusalsMutex sync.Mutex
+)
+
+// RefuseAfterHandshake keeps a refused connection open until the player handshake arrives, so
+// the refusal can be sent as disconnect message. Players not sending it in time are disconnected.
+// It returns false when too many refusals are pending, the connection must then be closed.
+func (c *Connection) RefuseAfterHandshake(message string) bool {
+	pendingRefusalsMutex.Lock()
+	defer pendingRefusalsMutex.Unlock()
+	if len(pendingRefusals) >= maxPendingRefusals {
+		return false
+	}
+	if len(pendingRefusals) == 0 {
+		go sweepRefusals()
+	}
+	pendingRefusals[c] = time.Now().Add(refusalTimeout)
+	c.Refusal = message
+	return true
+}
+
+// forgetRefusal frees the place of a closed connection among the pending refusals
+func (c *Connection) forgetRefusal() {
+	if c.Refusal == "" {
+		return
+	}
+	pendingRefusalsMutex.Lock()
+	defer pendingRefusalsMutex.Unlock()
+	delete(pendingRefusals, c)
+}
+
+// sweepRefusals disconnects the refused players who didn't send their handshake in time, until none is pending
+func sweepRefusals() {
+	ticker := time.NewTicker(refusalTimeout / 4)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		pendingRefusalsMutex.Lock()
+		for c, deadline := range pendingRefusals {
+			if now.After(deadline) {
+				delete(pendingRefusals, c)
+				if clientConn := c.ClientConn; clientConn != nil {
+					clientConn.Close()
+				}
+			}
+		}
+		done := len(pendingRefusals) == 0
+		pendingRefusalsMutex.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
 func (c *Connection) SendConnectionID() []byte {
 	// Create magic packet with connection ID and proxy info
 	// Format: "TUNNELLED_ID:" + ConnectionID + "|PROXY_INFO:" + encoded_proxy_info + "\n"
 	magicPacket := "TUNNELLED_ID:" + c.ConnectionID
+	// The server only hands a live session over to a tunnel proving it knows the shared token
+	if signature := signConnectionID(c.ConnectionID); signature != "" {
+		magicPacket += "|AUTH:" + signature
+	}
+	// A migrating client tells how much it sent on the old tunnel, stateMutex is held by the caller
+	if c.handover != nil {
+		magicPacket += fmt.Sprintf("|HANDOVER:%d", c.tunnelSent)
+	}
 	
 	// Always add proxy info (either extracted from HAProxy or inferred from connection)
 	var proxyInfo *haproxy.ProxyInfo
@@ -90,6 +325,14 @@ func (c *Connection) SendConnectionID() []byte {
 			proxyInfo.SrcIP.String(), proxyInfo.SrcPort,
 			proxyInfo.DstIP.String(), proxyInfo.DstPort)
 		magicPacket += "|PROXY_INFO:" + proxyStr
+		if proxyInfo.Local {
+			magicPacket += "|LOCAL"
+		}
+
+		// TLVs received from the proxy in front of us, the server picks the ones sent to its backend
+		if tlvs := forwardedTLVs(proxyInfo.TLVs); len(tlvs) > 0 {
+			magicPacket += "|TLVS:" + base64.StdEncoding.EncodeToString(haproxy.EncodeTLVs(tlvs))
+		}
 	}
 	
 	magicPacket += "\n"
@@ -138,10 +381,11 @@ func (c *Connection) inferProxyInfo() *haproxy.ProxyInfo {
 	}
 }
 
+// IsConnectionIDPacket checks if data starts with a connection ID packet, which may be followed by regular traffic
 func (c *Connection) IsConnectionIDPacket(data []byte) (bool, string) {
 	packetStr := string(data)
 	if len(packetStr) > 13 && packetStr[:13] == "TUNNELLED_ID:" {
-		if endIdx := len(packetStr) - 1; packetStr[endIdx] == '\n' {
+		if endIdx := strings.IndexByte(packetStr, '\n'); endIdx != -1 {
 			content := packetStr[13:endIdx]
 			return true, content
 		}
@@ -149,19 +393,43 @@ func (c *Connection) IsConnectionIDPacket(data []byte) (bool, string) {
 	return false, ""
 }
 
-func (c *Connection) ParseConnectionIDPacket(content string) (string, *haproxy.ProxyInfo) {
+// ParseConnectionIDPacket returns the connection ID, the proxy info and the HMAC of the ID (empty if missing)
+func (c *Connection) ParseConnectionIDPacket(content string) (string, *haproxy.ProxyInfo, string) {
 	parts := strings.Split(content, "|")
 	connectionID := parts[0]
 	
 	var proxyInfo *haproxy.ProxyInfo
+	var tlvs []haproxy.TLV
+	local := false
+	signature := ""
 	for _, part := range parts[1:] {
+		if part == "LOCAL" {
+			local = true
+			continue
+		}
+		if strings.HasPrefix(part, "AUTH:") {
+			signature = part[5:]
+			continue
+		}
 		if strings.HasPrefix(part, "PROXY_INFO:") {
 			proxyStr := part[11:] // Remove "PROXY_INFO:" prefix
 			proxyInfo = c.parseProxyInfo(proxyStr)
+		} else if strings.HasPrefix(part, "TLVS:") {
+			data, err := base64.StdEncoding.DecodeString(part[5:])
+			if err == nil {
+				tlvs, err = haproxy.DecodeTLVs(data)
+			}
+			if err != nil {
+				fmt.Printf("Ignoring invalid TLVs of connection %s: %v\n", connectionID, err)
+			}
 		}
 	}
+	if proxyInfo != nil {
+		proxyInfo.TLVs = tlvs
+		proxyInfo.Local = local
+	}
 	
-	return connectionID, proxyInfo
+	return connectionID, proxyInfo, signature
 }
 
 func (c *Connection) parseProxyInfo(proxyStr string) *haproxy.ProxyInfo {
@@ -201,7 +469,20 @@ func (c *Connection) parseProxyInfo(proxyStr string) *haproxy.ProxyInfo {
 
 // ProcessHAProxyData processes incoming data for HAProxy protocol headers
 func (c *Connection) ProcessHAProxyData(data []byte) ([]byte, error) {
-	if c.HAProxyProcessed {
+	if c.HAProxyProcessed.Load() {
+		return data, nil
+	}
+
+	inbound := c.Listener.Route.InboundProxy()
+
+	// Only trusted proxies may send a header, anyone else could spoof their IP
+	trusted := inbound.Trusts(c.peerIP())
+	if !trusted && inbound.Mode == router.InboundRequired {
+		metrics.Inc(metrics.ProxyHeaderRejected, c.Listener.Route.RouteID)
+		return nil, fmt.Errorf("untrusted peer %s on a route requiring a HAProxy header", c.peerIP())
+	}
+	if !trusted && inbound.Untrusted == router.UntrustedPayload {
+		c.headerDone()
 		return data, nil
 	}
 
@@ -209,21 +490,34 @@ func (c *Connection) ProcessHAProxyData(data []byte) ([]byte, error) {
 	c.PendingData = append(c.PendingData, data...)
 
 	// Check if we have enough data to determine if it's HAProxy
-	if len(c.PendingData) < 5 {
+	if haproxy.IsHeaderPrefix(c.PendingData) {
 		return nil, nil // Need more data
 	}
 
 	// Check if this looks like HAProxy protocol
 	isHAProxy, version := haproxy.IsHAProxyHeader(c.PendingData)
+	if isHAProxy && !trusted {
+		metrics.Inc(metrics.ProxyHeaderRejected, c.Listener.Route.RouteID)
+		return nil, fmt.Errorf("HAProxy header from untrusted peer %s rejected", c.peerIP())
+	}
 	if !isHAProxy {
+		if inbound.Mode == router.InboundRequired {
+			metrics.Inc(metrics.ProxyHeaderInvalid, c.Listener.Route.RouteID)
+			return nil, errors.New("HAProxy header required but not received")
+		}
 		// Not HAProxy, mark as processed and return all pending data
-		c.HAProxyProcessed = true
+		c.headerDone()
 		result := make([]byte, len(c.PendingData))
 		copy(result, c.PendingData)
 		c.PendingData = nil
 		return result, nil
 	}
 
+	if !inbound.Accepts(version) {
+		metrics.Inc(metrics.ProxyHeaderInvalid, c.Listener.Route.RouteID)
+		return nil, fmt.Errorf("HAProxy v%d header not accepted on this route", version)
+	}
+
 	// Parse HAProxy header
 	var proxyInfo *haproxy.ProxyInfo
 	var headerSize int
@@ -238,15 +532,27 @@ func (c *Connection) ProcessHAProxyData(data []byte) ([]byte, error) {
 	}
 
 	if err != nil {
-		// Check if we need more data
-		if len(c.PendingData) < 512 { // Reasonable buffer size
+		// The parsers know the exact header size, waiting is bounded by the header deadline
+		if errors.Is(err, haproxy.ErrIncomplete) {
 			return nil, nil // Need more data
 		}
+		metrics.Inc(metrics.ProxyHeaderInvalid, c.Listener.Route.RouteID)
 		return nil, err
 	}
 
+	// Health checks of the proxy and unknown protocols don't carry addresses, the connection ones are used
+	if !proxyInfo.HasAddresses() {
+		if proxyInfo.Local {
+			fmt.Printf("HAProxy LOCAL connection (health check) on route %s\n", c.Listener.Route.RouteID)
+		}
+		if inferred := c.inferProxyInfo(); inferred != nil {
+			proxyInfo.SrcIP, proxyInfo.SrcPort = inferred.SrcIP, inferred.SrcPort
+			proxyInfo.DstIP, proxyInfo.DstPort = inferred.DstIP, inferred.DstPort
+		}
+	}
+
 	c.ProxyInfo = proxyInfo
-	c.HAProxyProcessed = true
+	c.headerDone()
 
 	// Return remaining data after HAProxy header
 	remainingData := c.PendingData[headerSize:]
@@ -255,31 +561,152 @@ func (c *Connection) ProcessHAProxyData(data []byte) ([]byte, error) {
 	return remainingData, nil
 }
 
+// StartHeaderDeadline closes the connection if its PROXY header isn't complete in time,
+// so stalled peers can't hold connections and backend dials forever
+func (c *Connection) StartHeaderDeadline() {
+	inbound := c.Listener.Route.InboundProxy()
+	if inbound.Mode == router.InboundOff {
+		return
+	}
+
+	deadline := inbound.HeaderDeadline()
+	c.headerTimer = time.AfterFunc(deadline, func() {
+		if c.HAProxyProcessed.Load() {
+			return
+		}
+		metrics.Inc(metrics.ProxyHeaderTimeout, c.Listener.Route.RouteID)
+		c.reportOffence(c.peerIP(), bans.OffenceProxyHeader)
+		// The timer runs outside of the event loop, OnClose turns the reason into CloseReason
+		reason := fmt.Sprintf("no complete HAProxy header within %v", deadline)
+		c.headerExpired.Store(&reason)
+		fmt.Printf("HAProxy > Closing connection %s from %s: %s\n", c.ConnectionID, c.peerIP(), reason)
+		if clientConn := c.ClientConn; clientConn != nil {
+			clientConn.Close()
+		}
+	})
+}
+
+// headerDone marks the PROXY header as processed, stopping its deadline
+func (c *Connection) headerDone() {
+	c.HAProxyProcessed.Store(true)
+	if c.headerTimer != nil {
+		c.headerTimer.Stop()
+	}
+}
+
+// peerIP returns the IP of the directly connected peer, ignoring any PROXY header
+func (c *Connection) peerIP() net.IP {
+	if c.ClientConn == nil {
+		return nil
+	}
+	return remoteIP(c.ClientConn)
+}
+
+// remoteIP returns the IP of the other end of a connection
+func remoteIP(conn gnet.Conn) net.IP {
+	if conn.RemoteAddr() == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// reportOffence scores a protocol error of ip for the auto ban: the peer for PROXY header errors, the effective
+// source IP otherwise, which is the proxy itself when it sent no header. Explicitly trusted proxies are never
+// scored, banning them would ban every player behind.
+func (c *Connection) reportOffence(ip net.IP, kind string) {
+	inbound := c.Listener.Route.InboundProxy()
+	if len(inbound.TrustedProxies) > 0 && inbound.Trusts(ip) {
+		return
+	}
+	bans.Report(ip, kind, c.Listener.Route.RouteID)
+}
+
 // GenerateHAProxyHeader generates HAProxy header to send to backend
 func (c *Connection) GenerateHAProxyHeader() []byte {
 	if c.ProxyInfo == nil {
 		return nil
 	}
 
-	if c.Listener.Route.HAProxy == "v1" {
+	outbound := c.Listener.Route.OutboundProxy()
+	if outbound.Version == router.HAProxyV1 {
 		return c.ProxyInfo.GenerateV1()
-	} else if c.Listener.Route.HAProxy == "v2" {
-		return c.ProxyInfo.GenerateV2()
+	} else if outbound.Version == router.HAProxyV2 {
+		return c.ProxyInfo.GenerateV2(c.outboundTLVs(outbound.TLVs)...)
 	}
 
 	return nil
 }
 
+// outboundTLVs picks the TLVs sent to the backend among the ones received through the tunnel.
+// UNIQUE_ID is always our connection ID, and CRC32C is computed when the header is generated.
+func (c *Connection) outboundTLVs(names []string) []haproxy.TLV {
+	var tlvs []haproxy.TLV
+	for _, name := range names {
+		tlvType, err := haproxy.ParseTLVName(name)
+		if err != nil {
+			continue
+		}
+
+		switch tlvType {
+		case haproxy.TypeUniqueID:
+			tlvs = append(tlvs, haproxy.TLV{Type: haproxy.TypeUniqueID, Value: []byte(c.ConnectionID)})
+		case haproxy.TypeCRC32C:
+			tlvs = append(tlvs, haproxy.TLV{Type: haproxy.TypeCRC32C})
+		default:
+			for _, tlv := range c.ProxyInfo.TLVs {
+				if tlv.Type == tlvType {
+					tlvs = append(tlvs, tlv)
+				}
+			}
+		}
+	}
+	return tlvs
+}
+
+// forwardedTLVs drops the TLVs that only make sense for the header they were received in
+func forwardedTLVs(tlvs []haproxy.TLV) []haproxy.TLV {
+	var forwarded []haproxy.TLV
+	for _, tlv := range tlvs {
+		if tlv.Type != haproxy.TypeCRC32C && tlv.Type != haproxy.TypeNoop {
+			forwarded = append(forwarded, tlv)
+		}
+	}
+	return forwarded
+}
+
+// FlushQueue sends the queued packets to the backend connection, stateMutex must be held.
+// Writes are asynchronous since the backend connection belongs to another event loop.
 func (c *Connection) FlushQueue() {
 	c.QueueMutex.Lock()
 	defer c.QueueMutex.Unlock()
 
 	for _, packet := range c.PacketQueue {
 		if c.BackendConn != nil {
-			c.BackendConn.Write(packet)
+			c.BackendConn.AsyncWrite(packet, nil)
+			if !c.Listener.IsServer {
+				c.tunnelSent += uint64(len(packet))
+			}
 		}
 	}
 	c.PacketQueue = c.PacketQueue[:0]
+	c.QueueOverflowed = false
+}
+
+// writeBackend forwards player data to the backend connection, or queues it until there's one
+// (still connecting, reconnecting or migrating). stateMutex must be held.
+func (c *Connection) writeBackend(data []byte) {
+	if c.IsConnected && c.BackendConn != nil && !c.Migrating {
+		c.BackendConn.AsyncWrite(data, nil)
+		if !c.Listener.IsServer {
+			c.tunnelSent += uint64(len(data))
+		}
+		return
+	}
+	c.QueuePacket(data)
 }
 
 func (c *Connection) GetReconnectDelay() time.Duration {
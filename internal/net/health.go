@@ -0,0 +1,83 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"tunnelled/internal/events"
+	"tunnelled/internal/router"
+)
+
+// TunnelDownThreshold is how long the backend of a route must be unreachable before it's reported as down
+var TunnelDownThreshold = 60 * time.Second
+
+type routeHealth struct {
+	mutex     sync.Mutex
+	downSince time.Time
+	reported  bool
+	timer     *time.Timer
+}
+
+var routesHealth sync.Map // route ID -> *routeHealth
+
+func getRouteHealth(routeID string) *routeHealth {
+	value, _ := routesHealth.LoadOrStore(routeID, &routeHealth{})
+	return value.(*routeHealth)
+}
+
+// markBackendDown records a failed dial or lost backend, and reports the route as down
+// once it stays unreachable for TunnelDownThreshold.
+func markBackendDown(route *router.Route) {
+	health := getRouteHealth(route.RouteID)
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if !health.downSince.IsZero() {
+		return
+	}
+	health.downSince = time.Now()
+	health.timer = time.AfterFunc(TunnelDownThreshold, func() {
+		health.mutex.Lock()
+		defer health.mutex.Unlock()
+
+		if health.downSince.IsZero() || health.reported {
+			return
+		}
+		health.reported = true
+		backendIP, backendPort := route.Backend()
+		fmt.Printf("Backend for route %s has been unreachable for %v\n", route.RouteID, time.Since(health.downSince).Round(time.Second))
+		events.Publish(events.Event{
+			Type:    events.TunnelDown,
+			RouteID: route.RouteID,
+			Data: map[string]any{
+				"down_since":   health.downSince,
+				"backend_ip":   backendIP,
+				"backend_port": backendPort,
+			},
+		})
+	})
+}
+
+// markBackendUp clears the down state of a route, reporting the recovery if the outage was reported
+func markBackendUp(route *router.Route) {
+	health := getRouteHealth(route.RouteID)
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if health.downSince.IsZero() {
+		return
+	}
+	if health.timer != nil {
+		health.timer.Stop()
+	}
+	if health.reported {
+		events.Publish(events.Event{
+			Type:    events.TunnelRestored,
+			RouteID: route.RouteID,
+			Data:    map[string]any{"down_seconds": int64(time.Since(health.downSince).Seconds())},
+		})
+	}
+	health.downSince = time.Time{}
+	health.reported = false
+	health.timer = nil
+}
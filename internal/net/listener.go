@@ -1,10 +1,16 @@
 package net
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
+	"tunnelled/internal/bans"
+	"tunnelled/internal/events"
+	"tunnelled/internal/haproxy"
+	"tunnelled/internal/limits"
+	"tunnelled/internal/metrics"
 	"tunnelled/internal/net/dialer"
 	"tunnelled/internal/router"
 
@@ -15,7 +21,7 @@ type Manager struct {
 	Listeners map[string]*Listener
 }
 
-// Global connection manager for server mode
+// Global connection registry, every live Connection is tracked here in both client and server mode
 var (
 	ActiveConnections = make(map[string]*Connection)
 	ConnectionsMutex  sync.RWMutex
@@ -28,11 +34,15 @@ func RegisterConnection(connectionID string, conn *Connection) {
 	fmt.Printf("Registered connection %s\n", connectionID)
 }
 
-func UnregisterConnection(connectionID string) {
+// UnregisterConnection removes the connection from the registry, unless it has already
+// been replaced by a newer Connection with the same ID (e.g. after a tunnel reconnect).
+func UnregisterConnection(conn *Connection) {
 	ConnectionsMutex.Lock()
 	defer ConnectionsMutex.Unlock()
-	delete(ActiveConnections, connectionID)
-	fmt.Printf("Unregistered connection %s\n", connectionID)
+	if current, exists := ActiveConnections[conn.ConnectionID]; exists && current == conn {
+		delete(ActiveConnections, conn.ConnectionID)
+		fmt.Printf("Unregistered connection %s\n", conn.ConnectionID)
+	}
 }
 
 func GetConnection(connectionID string) (*Connection, bool) {
@@ -42,12 +52,109 @@ func GetConnection(connectionID string) (*Connection, bool) {
 	return conn, exists
 }
 
+// ListConnections returns all live connections, optionally filtered by route ID (empty for all)
+func ListConnections(routeID string) []*Connection {
+	ConnectionsMutex.RLock()
+	defer ConnectionsMutex.RUnlock()
+
+	connections := make([]*Connection, 0, len(ActiveConnections))
+	for _, conn := range ActiveConnections {
+		if routeID != "" && conn.Listener.Route.RouteID != routeID {
+			continue
+		}
+		connections = append(connections, conn)
+	}
+	return connections
+}
+
+// KickBanned closes the live connections of the players covered by a ban, it returns how many were closed
+func KickBanned(ban *bans.Ban) int {
+	kicked := 0
+	for _, conn := range ListConnections("") {
+		if !ban.Matches(conn.SourceIP()) {
+			continue
+		}
+		reason := "You are banned from this server"
+		if ban.Reason != "" {
+			reason += ": " + ban.Reason
+		}
+		if err := conn.Kick(reason); err != nil {
+			fmt.Printf("Bans > Failed to kick %s: %v\n", conn.ConnectionID, err)
+			continue
+		}
+		kicked++
+	}
+	return kicked
+}
+
 type Listener struct {
 	gnet.BuiltinEventEngine
 
 	eng      gnet.Engine
 	Route    *router.Route
 	IsServer bool
+
+	// eng is only set once booted, a listener stopped before that shuts down as soon as it boots
+	engMutex sync.Mutex
+	booted   bool
+	stopped  bool
+}
+
+// Running listeners by route ID, so routes can be added and removed at runtime
+var (
+	runningListeners      = make(map[string]*Listener)
+	runningListenersMutex sync.Mutex
+)
+
+// StartListener fires up a listener for the route in the background
+func StartListener(route *router.Route, isServer bool) *Listener {
+	listener := &Listener{
+		Route:    route,
+		IsServer: isServer,
+	}
+
+	runningListenersMutex.Lock()
+	runningListeners[route.RouteID] = listener
+	runningListenersMutex.Unlock()
+
+	go listener.FireUp()
+	return listener
+}
+
+// StopListener shuts down the listener of a route, closing its connections
+func StopListener(routeID string) error {
+	runningListenersMutex.Lock()
+	listener, exists := runningListeners[routeID]
+	delete(runningListeners, routeID)
+	runningListenersMutex.Unlock()
+
+	if !exists {
+		return fmt.Errorf("no listener for route %s", routeID)
+	}
+	return listener.Stop()
+}
+
+// Stop shuts down the listener, closing its connections
+func (l *Listener) Stop() error {
+	l.engMutex.Lock()
+	l.stopped = true
+	booted, eng := l.booted, l.eng
+	l.engMutex.Unlock()
+	if !booted {
+		// Still starting or failed to bind, there's no engine to stop yet
+		fmt.Printf("Listener %s stopped before it started\n", l.Route.RouteID)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := eng.Stop(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to stop listener %s: %v", l.Route.RouteID, err)
+	}
+	fmt.Printf("Listener %s stopped\n", l.Route.RouteID)
+	return nil
 }
 
 // FireUp starts the listener to accept incoming connections
@@ -59,13 +166,33 @@ func (l *Listener) FireUp() {
 	bind := fmt.Sprintf("tcp://%s:%d", l.Route.BindIP, l.Route.BindPort)
 	err := gnet.Run(l, bind, gnet.WithMulticore(true), gnet.WithReusePort(true))
 	if err != nil {
-		panic(errors.Join(errors.New(fmt.Sprintf("failed to start listener %s over %s", l.Route.RouteID, bind)), err))
+		// Don't take the other routes down with us, just report the failure
+		err = errors.Join(errors.New(fmt.Sprintf("failed to start listener %s over %s", l.Route.RouteID, bind)), err)
+		fmt.Println(err)
+		events.Publish(events.Event{
+			Type:    events.ListenerFailed,
+			RouteID: l.Route.RouteID,
+			Data:    map[string]any{"bind": bind, "error": err.Error()},
+		})
 	}
 }
 
 func (l *Listener) OnBoot(eng gnet.Engine) gnet.Action {
+	l.engMutex.Lock()
 	l.eng = eng
+	l.booted = true
+	stopped := l.stopped
+	l.engMutex.Unlock()
+	if stopped {
+		return gnet.Shutdown
+	}
+
 	fmt.Printf("Listener %s is now listening on %s:%d\n", l.Route.RouteID, l.Route.BindIP, l.Route.BindPort)
+	events.Publish(events.Event{
+		Type:    events.ListenerStarted,
+		RouteID: l.Route.RouteID,
+		Data:    map[string]any{"bind_ip": l.Route.BindIP, "bind_port": l.Route.BindPort},
+	})
 	return gnet.None
 }
 
@@ -75,6 +202,11 @@ func (l *Listener) OnOpen(conn gnet.Conn) (out []byte, action gnet.Action) {
 	if l.IsServer {
 		// In server mode, incoming connections are from tunnelled-client
 		// We don't create a user connection yet, just wait for ConnectionID packet
+		if ban := bans.Check(remoteIP(conn)); ban != nil {
+			metrics.Inc(metrics.BanRefused, l.Route.RouteID)
+			fmt.Printf("Bans > Refused tunnel from banned %s\n", conn.RemoteAddr())
+			return nil, gnet.Close
+		}
 		fmt.Printf("Server mode: waiting for ConnectionID from client\n")
 		return nil, gnet.None
 	}
@@ -82,34 +214,111 @@ func (l *Listener) OnOpen(conn gnet.Conn) (out []byte, action gnet.Action) {
 	// Client mode: this is a real user connection
 	connection := NewConnection(l, conn)
 	conn.SetContext(connection)
+	RegisterConnection(connection.ConnectionID, connection)
+	connection.publish(events.ConnectionOpened, nil)
+
+	// With PROXY protocol the player IP is only known once the header is processed, see OnTraffic.
+	// A banned peer isn't given the chance to send one.
+	if l.Route.InboundProxy().Mode != router.InboundOff {
+		if ban := bans.Check(connection.peerIP()); ban != nil {
+			metrics.Inc(metrics.BanRefused, l.Route.RouteID)
+			connection.CloseReason = fmt.Sprintf("peer %s is banned", connection.peerIP())
+			fmt.Printf("Bans > Refused connection %s: %s\n", connection.ConnectionID, connection.CloseReason)
+			return nil, gnet.Close
+		}
+		connection.StartHeaderDeadline()
+		return nil, gnet.None
+	}
+	if !l.admit(connection) {
+		return nil, gnet.Close
+	}
+	return nil, gnet.None
+}
+
+// admit checks the player IP of a new connection against the bans, the route ACL and the route limits,
+// then dials the backend. Refused connections are never dialed, false means they must be closed right away.
+func (l *Listener) admit(connection *Connection) bool {
+	ip := connection.SourceIP()
+	if ban := bans.Check(ip); ban != nil {
+		metrics.Inc(metrics.BanRefused, l.Route.RouteID)
+		connection.CloseReason = fmt.Sprintf("%s is banned", ip)
+		if ban.Reason != "" {
+			connection.CloseReason += ": " + ban.Reason
+		}
+		fmt.Printf("Bans > Refused connection %s: %s\n", connection.ConnectionID, connection.CloseReason)
+		return false
+	}
+	if !l.Route.CurrentACL().Permits(ip) {
+		metrics.Inc(metrics.ACLDenied, l.Route.RouteID)
+		connection.CloseReason = fmt.Sprintf("%s denied by the ACL of route %s", ip, l.Route.RouteID)
+		fmt.Printf("ACL > Refused connection %s: %s\n", connection.ConnectionID, connection.CloseReason)
+		return false
+	}
+	release, err := limits.Admit(l.Route.RouteID, l.Route.Limits, ip)
+	if err != nil {
+		var refusal *limits.Refusal
+		if errors.As(err, &refusal) {
+			metrics.Inc(refusal.Metric, l.Route.RouteID)
+		}
+		connection.CloseReason = err.Error()
+		fmt.Printf("Limits > Refused connection %s: %s\n", connection.ConnectionID, connection.CloseReason)
+		return l.Route.Limits.Message != "" && connection.RefuseAfterHandshake(l.Route.Limits.Message)
+	}
+	connection.releaseLimits = release
 
 	th := &ReverseTrafficHandler{
 		Connection: connection,
 	}
-
 	l.attemptBackendConnection(connection, th)
-	return nil, gnet.None
+	return true
+}
+
+// dialBackend connects to the backend of the route. In transparent mode the server connects from the player IP,
+// except for health checks of the proxy in front of the client.
+func (l *Listener) dialBackend(connection *Connection, th *ReverseTrafficHandler) error {
+	backendIP, backendPort := l.Route.Backend()
+	address := fmt.Sprintf("%s:%d", backendIP, backendPort)
+	proxyInfo := connection.ProxyInfo
+	if !l.IsServer || !l.Route.Transparent || proxyInfo == nil || proxyInfo.Local || proxyInfo.SrcIP == nil {
+		_, err := dialer.GlobalClient.DialContext("tcp", address, th)
+		return err
+	}
+
+	conn, err := dialTransparent(address, proxyInfo.SrcIP)
+	if err != nil {
+		return fmt.Errorf("transparent dial from %s: %v", proxyInfo.SrcIP, err)
+	}
+	_, err = dialer.GlobalClient.EnrollContext(conn, th)
+	if err != nil {
+		conn.Close()
+	}
+	return err
 }
 
 func (l *Listener) attemptBackendConnection(connection *Connection, th *ReverseTrafficHandler) {
-	_, err := dialer.GlobalClient.DialContext("tcp", fmt.Sprintf("%s:%d", l.Route.BackendIP, l.Route.BackendPort), th)
+	// The dial returns once OnConnection ran, which marks the connection as connected
+	err := l.dialBackend(connection, th)
 	if err != nil {
 		fmt.Printf("Failed to connect to backend for listener %s: %v\n", l.Route.RouteID, err)
+		connection.stateMutex.Lock()
 		connection.IsConnected = false
+		connection.stateMutex.Unlock()
+		if !l.IsServer {
+			markBackendDown(l.Route)
+		}
 
 		// Only reconnect if we're in client mode
 		if !l.IsServer {
 			go l.scheduleReconnect(connection, th)
 		}
-		return
 	}
-	connection.IsConnected = true
-	connection.ReconnectAttempts = 0
 }
 
 func (l *Listener) scheduleReconnect(connection *Connection, th *ReverseTrafficHandler) {
+	connection.stateMutex.Lock()
 	// Never reconnect in server mode
 	if l.IsServer || connection.ClientConn == nil {
+		connection.stateMutex.Unlock()
 		fmt.Println("Ignoring reconnect attempt in server mode or no client connection")
 		return
 	}
@@ -117,13 +326,26 @@ func (l *Listener) scheduleReconnect(connection *Connection, th *ReverseTrafficH
 	delay := connection.GetReconnectDelay()
 	connection.ReconnectAttempts++
 	connection.LastReconnectTime = time.Now()
+	attempt := connection.ReconnectAttempts
+	connection.stateMutex.Unlock()
 
 	fmt.Printf("Scheduling reconnect attempt %d in %v for listener %s\n",
-		connection.ReconnectAttempts, delay, l.Route.RouteID)
-
-	time.Sleep(delay)
+		attempt, delay, l.Route.RouteID)
+	connection.publish(events.ReconnectScheduled, map[string]any{
+		"attempt":       attempt,
+		"delay_seconds": delay.Seconds(),
+	})
+
+	// A backend update skips the remaining delay
+	select {
+	case <-time.After(delay):
+	case <-connection.reconnectWake:
+	}
 
-	if connection.ClientConn != nil {
+	connection.stateMutex.Lock()
+	alive := connection.ClientConn != nil
+	connection.stateMutex.Unlock()
+	if alive {
 		l.attemptBackendConnection(connection, th)
 	}
 }
@@ -136,10 +358,51 @@ func (l *Listener) OnClose(conn gnet.Conn, err error) (action gnet.Action) {
 		return gnet.None
 	}
 
-	// Unregister connection in server mode
-	if l.IsServer {
-		UnregisterConnection(connection.ConnectionID)
+	connection.stateMutex.Lock()
+	if p := connection.pendingTunnel; p != nil && p.conn == conn {
+		// A new tunnel gave up before taking the session over
+		connection.pendingTunnel = nil
+		connection.stateMutex.Unlock()
+		fmt.Printf("Handover tunnel of connection %s closed before taking over\n", connection.ConnectionID)
+		return gnet.None
+	}
+	// This tunnel was replaced by a newer one (handover), the session lives on
+	if connection.ClientConn != nil && connection.ClientConn != conn {
+		connection.stateMutex.Unlock()
+		fmt.Printf("Old tunnel of connection %s closed after handover\n", connection.ConnectionID)
+		return gnet.None
+	}
+	if connection.pendingTunnel != nil {
+		// The old tunnel is gone during a handover, it delivered all it could
+		connection.completeHandover()
+		connection.stateMutex.Unlock()
+		return gnet.None
+	}
+	connection.stateMutex.Unlock()
+
+	UnregisterConnection(connection)
+	connection.forgetRefusal()
+	if connection.releaseLimits != nil {
+		connection.releaseLimits()
+	}
+	closeData := map[string]any{
+		"bytes_in":  connection.BytesIn.Load(),
+		"bytes_out": connection.BytesOut.Load(),
+	}
+	if err != nil {
+		closeData["error"] = err.Error()
+	}
+	if reason := connection.headerExpired.Load(); reason != nil {
+		connection.CloseReason = *reason
+	}
+	if connection.CloseReason != "" {
+		fmt.Printf("Connection %s closed by us: %s\n", connection.ConnectionID, connection.CloseReason)
+		closeData["reason"] = connection.CloseReason
 	}
+	connection.publish(events.ConnectionClosed, closeData)
+
+	connection.stateMutex.Lock()
+	defer connection.stateMutex.Unlock()
 
 	// Close backend connection when client disconnects
 	if connection.BackendConn != nil {
@@ -147,6 +410,14 @@ func (l *Listener) OnClose(conn gnet.Conn, err error) (action gnet.Action) {
 		connection.BackendConn.Close()
 		connection.BackendConn = nil
 	}
+	if h := connection.handover; h != nil {
+		connection.handover = nil
+		connection.Migrating = false
+		h.timer.Stop()
+		if h.conn != nil {
+			h.conn.Close()
+		}
+	}
 
 	connection.IsConnected = false
 	connection.ClientConn = nil
@@ -154,62 +425,155 @@ func (l *Listener) OnClose(conn gnet.Conn, err error) (action gnet.Action) {
 	return gnet.None
 }
 
+// openServerConnection creates the server side of a user session and connects it to the backend
+func (l *Listener) openServerConnection(connectionID string, clientConn gnet.Conn, proxyInfo *haproxy.ProxyInfo) *Connection {
+	// Create a new connection representing this user session
+	connection := &Connection{
+		Listener:          l,
+		ConnectionID:      connectionID,
+		CreatedAt:         time.Now(),
+		ClientConn:        clientConn, // The connection from tunnelled-client
+		ProxyInfo:         proxyInfo,  // Store proxy info from client
+		IsConnected:       false,      // Not connected to backend yet
+		PacketQueue:       make([][]byte, 0),
+		MaxReconnectDelay: 30 * time.Second,
+		MaxQueueSize:      1000,
+	}
+	connection.HAProxyProcessed.Store(true) // Already processed in client
+
+	if proxyInfo != nil {
+		fmt.Printf("Received proxy info: %s:%d -> %s:%d\n",
+			proxyInfo.SrcIP, proxyInfo.SrcPort, proxyInfo.DstIP, proxyInfo.DstPort)
+	}
+
+	clientConn.SetContext(connection)
+	RegisterConnection(connectionID, connection)
+	connection.publish(events.ConnectionOpened, nil)
+	fmt.Printf("Created connection for ID %s, connecting to backend\n", connectionID)
+
+	// Connect to actual backend (BungeeCord)
+	th := &ReverseTrafficHandler{
+		Connection: connection,
+	}
+	l.attemptBackendConnection(connection, th)
+	return connection
+}
+
+// reattachConnection attaches a live session to the tunnel a reconnecting client opened for it,
+// closing the old tunnel without touching the backend connection. It returns false if the session
+// has no backend connection anymore.
+func (l *Listener) reattachConnection(connection *Connection, clientConn gnet.Conn, proxyInfo *haproxy.ProxyInfo) bool {
+	connection.stateMutex.Lock()
+	defer connection.stateMutex.Unlock()
+	if connection.BackendConn == nil || connection.pendingTunnel != nil {
+		return false
+	}
+
+	oldConn := connection.ClientConn
+	connection.ClientConn = clientConn
+	if proxyInfo != nil {
+		connection.ProxyInfo = proxyInfo
+	}
+	connection.tunnelSent = 0
+	connection.tunnelReceived = 0
+	clientConn.SetContext(connection)
+
+	if oldConn != nil && oldConn != clientConn {
+		oldConn.Close()
+	}
+
+	fmt.Printf("Reattached connection %s to a new tunnel from %s\n", connection.ConnectionID, clientConn.RemoteAddr())
+	connection.publish(events.ConnectionMigrated, map[string]any{"tunnel": clientConn.RemoteAddr().String()})
+	return true
+}
+
 type ReverseTrafficHandler struct {
 	dialer.TrafficHandler
 	Connection *Connection
+
+	handover *handover // set on the new tunnel of a migration
 }
 
 func (l *Listener) OnTraffic(clientConn gnet.Conn) (action gnet.Action) {
+	if l.IsServer && clientConn.Context() == nil {
+		// The first packet of a tunnel is left in the gnet buffer until it's complete
+		if buffered, _ := clientConn.Peek(-1); handshakePending(buffered) {
+			return gnet.None
+		}
+	}
+
 	gnetBuffer, _ := clientConn.Next(-1)
 	data := make([]byte, len(gnetBuffer))
 	copy(data, gnetBuffer)
 
 	if l.IsServer {
-		// Server mode: check if this is a connection ID packet from client
-		isIDPacket, content := (&Connection{}).IsConnectionIDPacket(data)
-		if isIDPacket {
-			connectionID, proxyInfo := (&Connection{}).ParseConnectionIDPacket(content)
-			fmt.Printf("Received connection ID: %s from client\n", connectionID)
+		// Server mode: the first packet of a tunnel is the connection ID packet from client
+		conn, ok := clientConn.Context().(*Connection)
+		if !ok || conn == nil {
+			if IsProbePacket(data) {
+				// Reachability check from a client, not a user session
+				clientConn.Write(probeReply)
+				return gnet.Close
+			}
 
-			// Create a new connection representing this user session
-			connection := &Connection{
-				Listener:          l,
-				ConnectionID:      connectionID,
-				ClientConn:        clientConn, // The connection from tunnelled-client
-				ProxyInfo:         proxyInfo,  // Store proxy info from client
-				IsConnected:       false,      // Not connected to backend yet
-				PacketQueue:       make([][]byte, 0),
-				MaxReconnectDelay: 30 * time.Second,
-				MaxQueueSize:      1000,
-				HAProxyProcessed:  true, // Already processed in client
+			isIDPacket, content := (&Connection{}).IsConnectionIDPacket(data)
+			if !isIDPacket {
+				// Neither a probe nor an ID packet, even once complete
+				fmt.Printf("Server mode: invalid tunnel handshake from %s\n", clientConn.RemoteAddr())
+				bans.Report(remoteIP(clientConn), bans.OffenceTunnelHandshake, l.Route.RouteID)
+				return gnet.Close
 			}
+			// Anything sent right after the ID packet is regular traffic
+			rest := data[len("TUNNELLED_ID:")+len(content)+1:]
+
+			connectionID, proxyInfo, signature := (&Connection{}).ParseConnectionIDPacket(content)
+			fmt.Printf("Received connection ID: %s from client\n", connectionID)
 
-			if proxyInfo != nil {
-				fmt.Printf("Received proxy info: %s:%d -> %s:%d\n",
-					proxyInfo.SrcIP, proxyInfo.SrcPort, proxyInfo.DstIP, proxyInfo.DstPort)
+			existing, exists := GetConnection(connectionID)
+			if exists && !verifyConnectionID(connectionID, signature) {
+				// A known ID belongs to a live session, only the client holding the token may take it over
+				fmt.Printf("Refused tunnel for connection %s from %s: invalid signature\n", connectionID, clientConn.RemoteAddr())
+				return gnet.Close
 			}
 
-			clientConn.SetContext(connection)
-			RegisterConnection(connectionID, connection)
-			fmt.Printf("Created connection for ID %s, connecting to backend\n", connectionID)
+			if sent, ok := handoverRequest(content); ok {
+				// A migrating client waits for the handover acknowledgement before sending anything else
+				if !exists || existing.Listener != l || len(rest) > 0 || !existing.requestHandover(clientConn, proxyInfo, sent) {
+					fmt.Printf("Refused handover of connection %s to %s\n", connectionID, clientConn.RemoteAddr())
+					return gnet.Close
+				}
+				return gnet.None
+			}
 
-			// Connect to actual backend (BungeeCord)
-			th := &ReverseTrafficHandler{
-				Connection: connection,
+			if exists && existing.Listener == l && l.reattachConnection(existing, clientConn, proxyInfo) {
+				// The client reconnected this session on a new tunnel, keep the backend connection
+				conn = existing
+			} else {
+				conn = l.openServerConnection(connectionID, clientConn, proxyInfo)
 			}
-			l.attemptBackendConnection(connection, th)
 
-			return gnet.None
+			if len(rest) == 0 {
+				return gnet.None
+			}
+			data = rest
 		}
 
 		// Regular traffic in server mode - forward to backend (BungeeCord)
-		conn, ok := clientConn.Context().(*Connection)
-		if !ok || conn == nil {
+		conn.stateMutex.Lock()
+		defer conn.stateMutex.Unlock()
+		if p := conn.pendingTunnel; p != nil && p.conn == clientConn {
+			fmt.Printf("Server mode: traffic before the handover of connection %s\n", conn.ConnectionID)
 			return gnet.Close
 		}
-
-		if conn.BackendConn != nil {
-			conn.BackendConn.Write(data)
+		conn.BytesIn.Add(uint64(len(data)))
+		conn.InspectHandshake(data)
+		if clientConn == conn.ClientConn {
+			conn.tunnelReceived += uint64(len(data))
+		}
+		// Backend still connecting, it's flushed once connected
+		conn.writeBackend(data)
+		if p := conn.pendingTunnel; p != nil && conn.tunnelReceived >= p.expected {
+			conn.completeHandover()
 		}
 		return gnet.None
 	}
@@ -221,10 +585,13 @@ func (l *Listener) OnTraffic(clientConn gnet.Conn) (action gnet.Action) {
 	}
 
 	// Process HAProxy protocol if enabled on client
-	if conn.Listener.Route.HAProxy != router.HAProxyOFF {
+	if conn.Listener.Route.InboundProxy().Mode != router.InboundOff {
+		wasProcessed := conn.HAProxyProcessed.Load()
 		processedData, err := conn.ProcessHAProxyData(data)
 		if err != nil {
 			fmt.Printf("HAProxy parsing error: %v\n", err)
+			conn.CloseReason = err.Error()
+			conn.reportOffence(conn.peerIP(), bans.OffenceProxyHeader)
 			return gnet.Close
 		}
 		if processedData == nil {
@@ -232,73 +599,175 @@ func (l *Listener) OnTraffic(clientConn gnet.Conn) (action gnet.Action) {
 			return gnet.None
 		}
 		data = processedData
+		if !wasProcessed && !l.admit(conn) {
+			return gnet.Close
+		}
 		if len(data) == 0 {
 			// Only HAProxy header received, no actual data yet
 			return gnet.None
 		}
 	}
 
+	wasInspected := conn.HandshakeInspected
+	conn.BytesIn.Add(uint64(len(data)))
+	if err := conn.InspectHandshake(data); err != nil {
+		conn.reportOffence(conn.SourceIP(), bans.OffenceMinecraftHandshake)
+	}
+
+	if conn.Refusal != "" {
+		// Refused by the route limits, the player is only waited for to tell them why
+		if !wasInspected && conn.HandshakeInspected {
+			conn.Kick(conn.Refusal)
+		}
+		return gnet.None
+	}
+
 	// only debug print here to reduce spam
 	//fmt.Println("client sent traffic, forwarding to backend...")
 
-	if conn.IsConnected && conn.BackendConn != nil {
-		conn.BackendConn.Write(data)
-	} else {
-		// same debug here
-		// fmt.Println("Backend disconnected, queuing packet...")
-		conn.QueuePacket(data)
-	}
+	// Queued while the backend is disconnected or migrating
+	conn.stateMutex.Lock()
+	conn.writeBackend(data)
+	conn.stateMutex.Unlock()
 
 	return gnet.None
 }
 
 func (rth *ReverseTrafficHandler) HandleTraffic(gnetConn gnet.Conn, data []byte) gnet.Action {
 	//fmt.Println("backend sent traffic, forwarding to client...")
-	rth.Connection.ClientConn.Write(data)
+	c := rth.Connection
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if h := c.handover; h != nil && h.conn == gnetConn {
+		c.receiveHandover(h, data)
+		return gnet.None
+	}
+
+	c.BytesOut.Add(uint64(len(data)))
+	if c.Listener.IsServer {
+		if c.ClientConn != nil {
+			c.ClientConn.AsyncWrite(data, nil)
+			c.tunnelSent += uint64(len(data))
+		}
+		return gnet.None
+	}
+
+	if gnetConn == c.BackendConn {
+		c.tunnelReceived += uint64(len(data))
+	}
+	if c.ClientConn != nil {
+		c.ClientConn.AsyncWrite(data, nil)
+	}
+	if h := c.handover; h != nil && h.acked && gnetConn == c.BackendConn && c.tunnelReceived >= h.expected {
+		// The old tunnel delivered everything the server sent before the switch
+		c.finishHandover()
+	}
 	return gnet.None
 }
 
 func (rth *ReverseTrafficHandler) OnConnection(gnetConn gnet.Conn) {
-	rth.Connection.BackendConn = gnetConn
-	rth.Connection.IsConnected = true
-	rth.Connection.ReconnectAttempts = 0
+	c := rth.Connection
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if rth.handover != nil {
+		if c.handover != rth.handover {
+			// The migration was given up while dialing
+			gnetConn.Close()
+			return
+		}
+		// The old tunnel stays the backend connection until the server takes the session over
+		rth.handover.conn = gnetConn
+		gnetConn.Write(c.SendConnectionID())
+		markBackendUp(c.Listener.Route)
+		fmt.Printf("Sent handover of connection %s to %s\n", c.ConnectionID, gnetConn.RemoteAddr())
+		return
+	}
+
+	c.BackendConn = gnetConn
+	c.IsConnected = true
+	c.ReconnectAttempts = 0
+	c.tunnelSent = 0
+	c.tunnelReceived = 0
 	fmt.Printf("Backend connected for listener %s (ConnectionID: %s)\n",
-		rth.Connection.Listener.Route.RouteID, rth.Connection.ConnectionID)
+		c.Listener.Route.RouteID, c.ConnectionID)
+	c.publish(events.BackendConnected, nil)
+	if !c.Listener.IsServer {
+		markBackendUp(c.Listener.Route)
+	}
 
 	// Send HAProxy header if enabled in server mode and we have proxy info
-	if rth.Connection.Listener.IsServer && rth.Connection.Listener.Route.HAProxy != router.HAProxyOFF && rth.Connection.ProxyInfo != nil {
-		haproxyHeader := rth.Connection.GenerateHAProxyHeader()
+	outbound := c.Listener.Route.OutboundProxy()
+	if c.Listener.IsServer && outbound.Version != router.HAProxyOFF && c.ProxyInfo != nil {
+		haproxyHeader := c.GenerateHAProxyHeader()
 		if haproxyHeader != nil {
 			gnetConn.Write(haproxyHeader)
-			fmt.Printf("Sent HAProxy %s header to backend\n", rth.Connection.Listener.Route.HAProxy)
+			fmt.Printf("Sent HAProxy %s header to backend\n", outbound.Version)
 		}
 	}
 
 	// Send connection ID as first packet if in client mode
-	if !rth.Connection.Listener.IsServer {
-		magicPacket := rth.Connection.SendConnectionID()
+	if !c.Listener.IsServer {
+		magicPacket := c.SendConnectionID()
 		gnetConn.Write(magicPacket)
-		fmt.Printf("Sent connection ID %s to server\n", rth.Connection.ConnectionID)
+		fmt.Printf("Sent connection ID %s to server\n", c.ConnectionID)
 	}
 
-	rth.Connection.FlushQueue()
+	c.FlushQueue()
 }
 
 func (rth *ReverseTrafficHandler) OnDisconnection(gnetConn gnet.Conn, err error) {
-	fmt.Printf("Backend disconnected for listener %s: %v\n", rth.Connection.Listener.Route.RouteID, err)
-	rth.Connection.IsConnected = false
-	rth.Connection.BackendConn = nil
+	c := rth.Connection
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if h := c.handover; h != nil {
+		if h.conn == gnetConn {
+			c.abortHandover(fmt.Sprintf("the new tunnel closed: %v", err))
+			return
+		}
+		if c.BackendConn == gnetConn {
+			// The session isn't torn down, the server switches to the new tunnel when it notices
+			h.oldClosed = true
+			if h.acked {
+				c.finishHandover()
+			}
+			return
+		}
+	}
+	// A backend connection replaced by a migration, or the new tunnel of a migration given up, nothing to recover
+	if c.BackendConn != gnetConn && (c.BackendConn != nil || rth.handover != nil) {
+		fmt.Printf("Previous backend connection of %s closed: %v\n", c.ConnectionID, err)
+		return
+	}
 
-	if rth.Connection.Listener.IsServer {
+	fmt.Printf("Backend disconnected for listener %s: %v\n", c.Listener.Route.RouteID, err)
+	c.IsConnected = false
+	c.BackendConn = nil
+	var disconnectData map[string]any
+	if err != nil {
+		disconnectData = map[string]any{"error": err.Error()}
+	}
+	c.publish(events.BackendDisconnected, disconnectData)
+
+	if c.Listener.IsServer {
 		// In server mode: backend disconnect (BungeeCord) should close client connection
-		if rth.Connection.ClientConn != nil {
-			fmt.Printf("Closing client connection due to backend disconnect in server mode for listener %s\n", rth.Connection.Listener.Route.RouteID)
-			rth.Connection.ClientConn.Close()
-			rth.Connection.ClientConn = nil
+		if p := c.pendingTunnel; p != nil {
+			c.pendingTunnel = nil
+			p.conn.Close()
+		}
+		if c.ClientConn != nil {
+			fmt.Printf("Closing client connection due to backend disconnect in server mode for listener %s\n", c.Listener.Route.RouteID)
+			c.ClientConn.Close()
+			c.ClientConn = nil
 		}
 	} else {
 		// In client mode: keep client alive and try to reconnect to server
-		fmt.Printf("Keeping client alive, will try to reconnect to server for listener %s\n", rth.Connection.Listener.Route.RouteID)
-		go rth.Connection.Listener.scheduleReconnect(rth.Connection, rth)
+		if err != nil {
+			markBackendDown(c.Listener.Route)
+		}
+		fmt.Printf("Keeping client alive, will try to reconnect to server for listener %s\n", c.Listener.Route.RouteID)
+		go c.Listener.scheduleReconnect(c, rth)
 	}
 }
@@ -0,0 +1,306 @@
+package net
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tunnelled/internal/events"
+	"tunnelled/internal/haproxy"
+	"tunnelled/internal/net/dialer"
+	"tunnelled/internal/router"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// MigrateRoute moves every live client connection of the route to its current backend.
+// It's registered as a backend listener on the route manager, so IP updates switch sessions over
+// right away instead of waiting for the old tunnel to time out.
+func MigrateRoute(route *router.Route) {
+	connections := ListConnections(route.RouteID)
+	if len(connections) == 0 {
+		return
+	}
+
+	backendIP, backendPort := route.Backend()
+	fmt.Printf("Migrating %d connections of route %s to %s:%d\n", len(connections), route.RouteID, backendIP, backendPort)
+	for _, connection := range connections {
+		if connection.Listener.IsServer {
+			continue
+		}
+		connection.Migrate()
+	}
+}
+
+// handoverTimeout is how long a migration waits for the server to take the session over
+const handoverTimeout = 10 * time.Second
+
+// handoverAckPrefix starts the line the server sends first on the new tunnel once it took the session over,
+// followed by how much it sent on the old tunnel
+const handoverAckPrefix = "TUNNELLED_HANDOVER:"
+
+// handover is a migration of a client connection, the old tunnel stays the backend connection until it's done
+type handover struct {
+	conn      gnet.Conn   // the new tunnel, once connected
+	acked     bool        // the server took the session over
+	expected  uint64      // bytes the server sent on the old tunnel, the old tunnel is drained once received
+	oldClosed bool        // the old tunnel closed before the handover was done
+	pending   []byte      // received on the new tunnel, held back until the old one is drained
+	timer     *time.Timer // aborts the migration if the server doesn't answer in time
+}
+
+// pendingTunnel is a new tunnel asking the server for a live session, it takes the session over
+// once the old tunnel delivered the expected bytes
+type pendingTunnel struct {
+	conn      gnet.Conn
+	proxyInfo *haproxy.ProxyInfo
+	expected  uint64
+}
+
+// Migrate dials the route's backend and hands the session over to the new tunnel, the connection
+// to the Minecraft server is kept. Traffic from the player is queued while the new tunnel is being set up,
+// and the old tunnel carries the backend traffic until the server takes the session over.
+func (c *Connection) Migrate() {
+	c.stateMutex.Lock()
+	if c.ClientConn == nil || c.Migrating {
+		c.stateMutex.Unlock()
+		return
+	}
+	if !c.IsConnected || c.BackendConn == nil {
+		// Waiting for a reconnect, dial the new backend right away with a fresh backoff
+		c.ReconnectAttempts = 0
+		c.stateMutex.Unlock()
+		select {
+		case c.reconnectWake <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	h := &handover{}
+	h.timer = time.AfterFunc(handoverTimeout, func() {
+		c.stateMutex.Lock()
+		defer c.stateMutex.Unlock()
+		if c.handover != h {
+			return
+		}
+		if h.acked {
+			// The server switched, the old tunnel is stuck with the rest of its data
+			c.finishHandover()
+			return
+		}
+		c.abortHandover("the server didn't take the session over in time")
+	})
+	c.Migrating = true
+	c.handover = h
+	c.stateMutex.Unlock()
+
+	// The dial blocks until the new tunnel is open, the lock can't be held
+	backendIP, backendPort := c.Listener.Route.Backend()
+	th := &ReverseTrafficHandler{
+		Connection: c,
+		handover:   h,
+	}
+	_, err := dialer.GlobalClient.DialContext("tcp", fmt.Sprintf("%s:%d", backendIP, backendPort), th)
+	if err != nil {
+		c.stateMutex.Lock()
+		if c.handover == h {
+			c.abortHandover(fmt.Sprintf("cannot reach %s:%d: %v", backendIP, backendPort, err))
+		}
+		c.stateMutex.Unlock()
+	}
+}
+
+// receiveHandover handles the data of the new tunnel during a migration, the server first answers with
+// the handover acknowledgement. stateMutex must be held.
+func (c *Connection) receiveHandover(h *handover, data []byte) {
+	h.pending = append(h.pending, data...)
+	if h.acked {
+		return
+	}
+
+	line, rest, found := bytes.Cut(h.pending, []byte("\n"))
+	if !found {
+		if len(h.pending) > len(handoverAckPrefix)+20 {
+			c.abortHandover("invalid handover answer from the server")
+		}
+		return
+	}
+	expected, err := strconv.ParseUint(strings.TrimPrefix(string(line), handoverAckPrefix), 10, 64)
+	if !bytes.HasPrefix(line, []byte(handoverAckPrefix)) || err != nil {
+		c.abortHandover("invalid handover answer from the server")
+		return
+	}
+	h.acked = true
+	h.expected = expected
+	h.pending = append([]byte(nil), rest...)
+	if h.oldClosed || c.tunnelReceived >= h.expected {
+		c.finishHandover()
+	}
+}
+
+// finishHandover makes the new tunnel the backend connection once the server took the session over and the
+// old tunnel is drained, then the player traffic held back in both directions is sent. stateMutex must be held.
+func (c *Connection) finishHandover() {
+	h := c.handover
+	c.handover = nil
+	c.Migrating = false
+	h.timer.Stop()
+
+	if c.tunnelReceived < h.expected {
+		fmt.Printf("Old tunnel of connection %s lost %d bytes\n", c.ConnectionID, h.expected-c.tunnelReceived)
+	}
+	oldConn := c.BackendConn
+	c.BackendConn = h.conn
+	c.IsConnected = true
+	c.tunnelSent = 0
+	c.tunnelReceived = uint64(len(h.pending))
+	if len(h.pending) > 0 && c.ClientConn != nil {
+		c.BytesOut.Add(uint64(len(h.pending)))
+		c.ClientConn.AsyncWrite(h.pending, nil)
+	}
+	c.FlushQueue()
+	if oldConn != nil && !h.oldClosed {
+		oldConn.Close()
+	}
+
+	fmt.Printf("Migrated connection %s to %s\n", c.ConnectionID, h.conn.RemoteAddr())
+	c.publish(events.ConnectionMigrated, map[string]any{"backend": h.conn.RemoteAddr().String()})
+}
+
+// abortHandover gives up a migration, the session stays on the old tunnel or reconnects if it's gone too.
+// stateMutex must be held.
+func (c *Connection) abortHandover(reason string) {
+	h := c.handover
+	c.handover = nil
+	c.Migrating = false
+	h.timer.Stop()
+	if h.conn != nil {
+		h.conn.Close()
+	}
+	fmt.Printf("Failed to migrate connection %s: %s\n", c.ConnectionID, reason)
+
+	if !h.oldClosed && c.BackendConn != nil {
+		// Keep using the old tunnel, it fails over through the usual reconnect logic if it's dead
+		c.FlushQueue()
+		return
+	}
+	c.BackendConn = nil
+	c.IsConnected = false
+	markBackendDown(c.Listener.Route)
+	go c.Listener.scheduleReconnect(c, &ReverseTrafficHandler{Connection: c})
+}
+
+// handoverRequest returns how much a migrating client sent on the old tunnel, from the ID packet content
+func handoverRequest(content string) (uint64, bool) {
+	for _, part := range strings.Split(content, "|")[1:] {
+		if value, ok := strings.CutPrefix(part, "HANDOVER:"); ok {
+			sent, err := strconv.ParseUint(value, 10, 64)
+			return sent, err == nil
+		}
+	}
+	return 0, false
+}
+
+// requestHandover registers a new tunnel asking for the session, refused if the session has no backend
+// connection or is already being handed over. The server switches once the old tunnel delivered
+// everything the client sent on it.
+func (c *Connection) requestHandover(clientConn gnet.Conn, proxyInfo *haproxy.ProxyInfo, expected uint64) bool {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	if c.BackendConn == nil || c.ClientConn == nil || c.pendingTunnel != nil {
+		return false
+	}
+
+	clientConn.SetContext(c)
+	c.pendingTunnel = &pendingTunnel{conn: clientConn, proxyInfo: proxyInfo, expected: expected}
+	if c.tunnelReceived >= expected {
+		c.completeHandover()
+	}
+	return true
+}
+
+// completeHandover switches the session to the pending tunnel. The acknowledgement is queued before
+// any backend traffic can be written to the new tunnel. stateMutex must be held.
+func (c *Connection) completeHandover() {
+	p := c.pendingTunnel
+	c.pendingTunnel = nil
+
+	ack := fmt.Sprintf("%s%d\n", handoverAckPrefix, c.tunnelSent)
+	p.conn.AsyncWrite([]byte(ack), nil)
+	c.ClientConn = p.conn
+	if p.proxyInfo != nil {
+		c.ProxyInfo = p.proxyInfo
+	}
+	c.tunnelSent = 0
+	c.tunnelReceived = 0
+
+	fmt.Printf("Handed over connection %s to a new tunnel from %s\n", c.ConnectionID, p.conn.RemoteAddr())
+	c.publish(events.ConnectionMigrated, map[string]any{"tunnel": p.conn.RemoteAddr().String()})
+}
+
+// Keys proving a tunnel was opened by a tunnelled-client, the shared tokens. Clients sign with the first one,
+// servers accept any of them since every client edge may have its own token.
+var (
+	tunnelKeys      [][]byte
+	tunnelKeysMutex sync.RWMutex
+)
+
+// SetTunnelKeys sets the shared tokens signing connection IDs. Empty ones are skipped, and at least one is required:
+// without a key no session could ever be handed over to a new tunnel.
+func SetTunnelKeys(keys ...string) error {
+	var nonEmpty [][]byte
+	for _, key := range keys {
+		if key != "" {
+			nonEmpty = append(nonEmpty, []byte(key))
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return errors.New("no token to sign tunnel handovers, the .token file is empty")
+	}
+
+	tunnelKeysMutex.Lock()
+	defer tunnelKeysMutex.Unlock()
+	tunnelKeys = nonEmpty
+	return nil
+}
+
+// signConnectionID returns the HMAC of a connection ID sent in the ID packet, empty without a key
+func signConnectionID(connectionID string) string {
+	tunnelKeysMutex.RLock()
+	defer tunnelKeysMutex.RUnlock()
+	if len(tunnelKeys) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(connectionIDMAC(tunnelKeys[0], connectionID))
+}
+
+// verifyConnectionID checks the HMAC of a connection ID, a tunnel can only take over a live session with a valid one.
+// SetTunnelKeys makes sure there's a key to check it with.
+func verifyConnectionID(connectionID, signature string) bool {
+	mac, err := hex.DecodeString(signature)
+	if err != nil || len(mac) == 0 {
+		return false
+	}
+
+	tunnelKeysMutex.RLock()
+	defer tunnelKeysMutex.RUnlock()
+	for _, key := range tunnelKeys {
+		if hmac.Equal(mac, connectionIDMAC(key, connectionID)) {
+			return true
+		}
+	}
+	return false
+}
+
+func connectionIDMAC(key []byte, connectionID string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("tunnelled-handover:" + connectionID))
+	return h.Sum(nil)
+}
@@ -0,0 +1,68 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A probe checks that a tunnelled-server answers on an address, it's answered by the server listeners
+var (
+	probePacket = []byte("TUNNELLED_PROBE\n")
+	probeReply  = []byte("TUNNELLED_PONG\n")
+)
+
+// IsProbePacket reports whether the first packet of a tunnel is a reachability probe
+func IsProbePacket(data []byte) bool {
+	return bytes.Equal(data, probePacket)
+}
+
+// MaxIDPacketLength caps the first line of a tunnel, the connection ID packet with its base64 TLVs
+const MaxIDPacketLength = 128 * 1024
+
+var idPacketPrefix = []byte("TUNNELLED_ID:")
+
+// handshakePending reports whether the start of a tunnel may still become a probe or a complete
+// connection ID packet, TCP can split them over several reads
+func handshakePending(data []byte) bool {
+	if len(data) < len(probePacket) && bytes.HasPrefix(probePacket, data) {
+		return true
+	}
+	if len(data) < len(idPacketPrefix) {
+		return bytes.HasPrefix(idPacketPrefix, data)
+	}
+	return bytes.HasPrefix(data, idPacketPrefix) && bytes.IndexByte(data, '\n') == -1 && len(data) < MaxIDPacketLength
+}
+
+// Probe dials a tunnelled-server listener and waits for its answer, it returns the round trip time
+func Probe(ctx context.Context, address string) (time.Duration, error) {
+	start := time.Now()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	_, err = conn.Write(probePacket)
+	if err != nil {
+		return 0, err
+	}
+
+	reply := make([]byte, len(probeReply))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return 0, fmt.Errorf("no answer: %v", err)
+	}
+	if !bytes.Equal(reply, probeReply) {
+		return 0, fmt.Errorf("%s is not a tunnelled-server", address)
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package net
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// The test runs in its own network namespace: the backend listens on backendIP, and the player range
+// is routed locally like the policy routing of the README does for the return traffic
+const (
+	backendIP   = "192.0.2.10"
+	playerRange = "198.51.100.0/24"
+	playerIP    = "198.51.100.7"
+)
+
+func TestDialTransparentFromPlayerIP(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("transparent dialing needs root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the ip command is needed to set up the network namespace")
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, it's thrown away along with its namespace when the goroutine ends
+		runtime.LockOSThread()
+		err := unix.Unshare(unix.CLONE_NEWNET)
+		if err != nil {
+			result <- errSkip{fmt.Errorf("cannot create a network namespace: %v", err)}
+			return
+		}
+		result <- dialFromPlayer()
+	}()
+
+	err := <-result
+	if skip, ok := err.(errSkip); ok {
+		t.Skip(skip.err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type errSkip struct{ err error }
+
+func (e errSkip) Error() string { return e.err.Error() }
+
+// dialFromPlayer must run on the thread of the namespace, the ip commands and sockets are created in it
+func dialFromPlayer() error {
+	setup := [][]string{
+		{"link", "set", "lo", "up"},
+		{"addr", "add", backendIP + "/32", "dev", "lo"},
+		{"route", "add", "local", playerRange, "dev", "lo"},
+	}
+	for _, args := range setup {
+		output, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ip %v: %v: %s", args, err, output)
+		}
+	}
+
+	backend, err := net.Listen("tcp", backendIP+":0")
+	if err != nil {
+		return fmt.Errorf("backend listen: %v", err)
+	}
+	defer backend.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := dialTransparent(backend.Addr().String(), net.ParseIP(playerIP))
+	if err != nil {
+		return fmt.Errorf("transparent dial: %v", err)
+	}
+	defer conn.Close()
+
+	backendConn, ok := <-accepted
+	if !ok {
+		return fmt.Errorf("backend accept failed")
+	}
+	defer backendConn.Close()
+
+	seen := backendConn.RemoteAddr().(*net.TCPAddr).IP.String()
+	if seen != playerIP {
+		return fmt.Errorf("backend sees %s, want the player IP %s", seen, playerIP)
+	}
+
+	// The return traffic must make it back to the foreign source
+	_, err = backendConn.Write([]byte("pong"))
+	if err != nil {
+		return fmt.Errorf("backend write: %v", err)
+	}
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return fmt.Errorf("read from backend: %v", err)
+	}
+	if string(reply) != "pong" {
+		return fmt.Errorf("got %q from the backend", reply)
+	}
+	return nil
+}
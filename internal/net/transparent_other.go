@@ -0,0 +1,12 @@
+//go:build !linux
+
+package net
+
+import (
+	"errors"
+	"net"
+)
+
+func dialTransparent(address string, source net.IP) (net.Conn, error) {
+	return nil, errors.New("transparent mode is only supported on Linux")
+}
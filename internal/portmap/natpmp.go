@@ -0,0 +1,144 @@
+package portmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const natPMPPort = 5351
+
+// NATPMPClient talks NAT-PMP (RFC 6886) to the gateway, PCP gateways answer it too for backwards compatibility
+type NATPMPClient struct {
+	Gateway net.IP
+	port    int // natPMPPort if 0, fake gateways listen elsewhere
+}
+
+func NewNATPMPClient(gateway string) (*NATPMPClient, error) {
+	if gateway == "" {
+		ip, err := defaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		return &NATPMPClient{Gateway: ip}, nil
+	}
+
+	ip := net.ParseIP(gateway)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid NAT-PMP gateway address: %s", gateway)
+	}
+	return &NATPMPClient{Gateway: ip}, nil
+}
+
+func (c *NATPMPClient) Name() string {
+	return "natpmp"
+}
+
+func (c *NATPMPClient) ExternalIP(ctx context.Context) (string, error) {
+	resp, err := c.request(ctx, []byte{0, 0}, 12)
+	if err != nil {
+		return "", err
+	}
+	return net.IP(resp[8:12]).String(), nil
+}
+
+func (c *NATPMPClient) AddMapping(ctx context.Context, mapping Mapping) (time.Duration, error) {
+	return c.mapTCP(ctx, mapping.InternalPort, mapping.ExternalPort, uint32(mapping.Lifetime.Seconds()))
+}
+
+func (c *NATPMPClient) DeleteMapping(ctx context.Context, mapping Mapping) error {
+	// A mapping is deleted by requesting it with a lifetime of 0 and no suggested external port
+	_, err := c.mapTCP(ctx, mapping.InternalPort, 0, 0)
+	return err
+}
+
+func (c *NATPMPClient) mapTCP(ctx context.Context, internalPort, externalPort int, lifetime uint32) (time.Duration, error) {
+	msg := make([]byte, 12)
+	msg[1] = 2 // map TCP
+	binary.BigEndian.PutUint16(msg[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(msg[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(msg[8:12], lifetime)
+
+	resp, err := c.request(ctx, msg, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	mappedPort := int(binary.BigEndian.Uint16(resp[10:12]))
+	if lifetime > 0 && mappedPort != externalPort {
+		return 0, fmt.Errorf("gateway mapped port %d to %d instead of %d", internalPort, mappedPort, externalPort)
+	}
+	return time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second, nil
+}
+
+// request sends msg to the gateway with the RFC 6886 retransmission schedule (250ms, doubling)
+func (c *NATPMPClient) request(ctx context.Context, msg []byte, responseSize int) ([]byte, error) {
+	port := c.port
+	if port == 0 {
+		port = natPMPPort
+	}
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: c.Gateway, Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach NAT-PMP gateway %s: %v", c.Gateway, err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for attempt := 0; attempt < 5; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return nil, fmt.Errorf("failed to send NAT-PMP request: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			timeout *= 2
+			continue
+		}
+		if n < responseSize || buf[0] != 0 || buf[1] != msg[1]|0x80 {
+			continue
+		}
+		if result := binary.BigEndian.Uint16(buf[2:4]); result != 0 {
+			return nil, fmt.Errorf("NAT-PMP gateway returned result code %d", result)
+		}
+		return buf[:n], nil
+	}
+
+	return nil, fmt.Errorf("NAT-PMP gateway %s did not answer", c.Gateway)
+}
+
+// defaultGateway reads the IPv4 default route from /proc/net/route (Linux only)
+func defaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find default gateway, set it in the config: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// The kernel prints the address in host (little endian) order
+		return net.IPv4(raw[3], raw[2], raw[1], raw[0]), nil
+	}
+
+	return nil, fmt.Errorf("no default gateway found, set it in the config")
+}
@@ -0,0 +1,269 @@
+package portmap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/events"
+	"tunnelled/internal/router"
+)
+
+// Mapper creates port mappings on the home router
+type Mapper interface {
+	Name() string
+	ExternalIP(ctx context.Context) (string, error)
+	// AddMapping creates or refreshes the mapping, returning the lifetime granted by the router (0 for permanent)
+	AddMapping(ctx context.Context, mapping Mapping) (time.Duration, error)
+	DeleteMapping(ctx context.Context, mapping Mapping) error
+}
+
+type Mapping struct {
+	InternalPort int
+	ExternalPort int
+	Description  string
+	Lifetime     time.Duration
+}
+
+// Service keeps a port mapping alive for the bind port of every route
+type Service struct {
+	config       config.PortMappingConfig
+	routeManager *router.Manager
+
+	mapper      Mapper
+	mapperMutex sync.Mutex
+
+	// mappings are the ports mapped by the last pass, by external port. mappingsMutex is held for
+	// whole passes so Stop doesn't race with one, stopped prevents any pass after it.
+	mappings      map[int]Mapping
+	mappingsMutex sync.Mutex
+	stopped       bool
+}
+
+func NewService(cfg config.PortMappingConfig, routeManager *router.Manager) *Service {
+	if cfg.Lifetime <= 0 {
+		cfg.Lifetime = 3600
+	}
+	return &Service{
+		config:       cfg,
+		routeManager: routeManager,
+		mappings:     make(map[int]Mapping),
+	}
+}
+
+// Start maps every route and keeps the mappings renewed, remapping right away when the public IP
+// changes since some routers drop their forwards along with the WAN address.
+func (s *Service) Start() {
+	ipChanges, _ := events.Subscribe(4, events.IPChanged)
+
+	go func() {
+		for {
+			renewIn := s.MapRoutes()
+
+			select {
+			case <-time.After(renewIn):
+			case <-ipChanges:
+				fmt.Println("PortMap > Public IP changed, refreshing port mappings")
+			}
+		}
+	}()
+}
+
+// MapRoutes creates the mappings of every route and deletes the ones of removed routes,
+// returning when they should be renewed
+func (s *Service) MapRoutes() time.Duration {
+	lifetime := time.Duration(s.config.Lifetime) * time.Second
+	renewIn := lifetime / 2
+
+	s.mappingsMutex.Lock()
+	defer s.mappingsMutex.Unlock()
+	if s.stopped {
+		return renewIn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	mapper, err := s.getMapper(ctx)
+	if err != nil {
+		fmt.Printf("PortMap > %v\n", err)
+		return time.Minute
+	}
+
+	// Routes which failed to map are kept too, the router may still hold their previous mapping
+	current := make(map[int]Mapping)
+	s.routeManager.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*router.Route)
+		if !ok {
+			return true
+		}
+
+		mapping := Mapping{
+			InternalPort: route.BindPort,
+			ExternalPort: route.BindPort,
+			Description:  "tunnelled " + route.RouteID,
+			Lifetime:     lifetime,
+		}
+		current[mapping.ExternalPort] = mapping
+		granted, err := mapper.AddMapping(ctx, mapping)
+		if err != nil {
+			fmt.Printf("PortMap > Failed to map port %d for route %s with %s: %v\n", route.BindPort, route.RouteID, mapper.Name(), err)
+			events.Publish(events.Event{
+				Type:    events.PortMappingFailed,
+				RouteID: route.RouteID,
+				Data:    map[string]any{"port": route.BindPort, "method": mapper.Name(), "error": err.Error()},
+			})
+			// The router may have rebooted or changed, look it up again next time
+			s.resetMapper()
+			renewIn = time.Minute
+			return true
+		}
+
+		fmt.Printf("PortMap > Mapped port %d for route %s with %s\n", route.BindPort, route.RouteID, mapper.Name())
+		if granted > 0 && granted/2 < renewIn {
+			renewIn = granted / 2
+		}
+		return true
+	})
+
+	for port, mapping := range s.mappings {
+		if _, ok := current[port]; ok {
+			continue
+		}
+		err := mapper.DeleteMapping(ctx, mapping)
+		if err != nil {
+			// Deleted again on the next pass
+			fmt.Printf("PortMap > Failed to delete mapping of port %d with %s: %v\n", port, mapper.Name(), err)
+			current[port] = mapping
+			continue
+		}
+		fmt.Printf("PortMap > Deleted mapping of port %d, its route is gone\n", port)
+	}
+	s.mappings = current
+
+	if renewIn < 30*time.Second {
+		renewIn = 30 * time.Second
+	}
+	return renewIn
+}
+
+// Stop deletes every mapping and stops renewing them, it's called on shutdown
+func (s *Service) Stop() {
+	s.mappingsMutex.Lock()
+	defer s.mappingsMutex.Unlock()
+	s.stopped = true
+	if len(s.mappings) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mapper, err := s.getMapper(ctx)
+	if err != nil {
+		fmt.Printf("PortMap > Failed to delete mappings: %v\n", err)
+		return
+	}
+	for port, mapping := range s.mappings {
+		err := mapper.DeleteMapping(ctx, mapping)
+		if err != nil {
+			fmt.Printf("PortMap > Failed to delete mapping of port %d with %s: %v\n", port, mapper.Name(), err)
+			continue
+		}
+		fmt.Printf("PortMap > Deleted mapping of port %d\n", port)
+	}
+	s.mappings = make(map[int]Mapping)
+}
+
+// Name and PublicIP make the service usable as an IP discovery provider, reporting the router's WAN address
+func (s *Service) Name() string {
+	return "portmap"
+}
+
+func (s *Service) PublicIP(ctx context.Context) (string, error) {
+	ip, err := s.WANAddress(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// A private or shared WAN address means there is another NAT upstream, the router's IP is useless
+	parsed := net.ParseIP(ip)
+	if parsed.IsPrivate() || parsed.IsUnspecified() || isSharedAddress(parsed) {
+		return "", fmt.Errorf("router WAN address %s is not public, the connection is likely behind carrier-grade NAT", ip)
+	}
+	return ip, nil
+}
+
+// WANAddress returns the external address reported by the router, whatever it is
+func (s *Service) WANAddress(ctx context.Context) (string, error) {
+	mapper, err := s.getMapper(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ip, err := mapper.ExternalIP(ctx)
+	if err != nil {
+		s.resetMapper()
+		return "", err
+	}
+	return ip, nil
+}
+
+func (s *Service) getMapper(ctx context.Context) (Mapper, error) {
+	s.mapperMutex.Lock()
+	defer s.mapperMutex.Unlock()
+
+	if s.mapper != nil {
+		return s.mapper, nil
+	}
+
+	var errs []error
+	if s.config.Method == "" || s.config.Method == "auto" || s.config.Method == "upnp" {
+		var client *UPnPClient
+		var err error
+		if s.config.GatewayURL != "" {
+			client, err = NewUPnPClient(ctx, s.config.GatewayURL)
+		} else {
+			client, err = DiscoverUPnP(ctx)
+		}
+		if err == nil {
+			fmt.Printf("PortMap > Using UPnP gateway at %s\n", client.ControlURL)
+			s.mapper = client
+			return client, nil
+		}
+		errs = append(errs, fmt.Errorf("upnp: %v", err))
+	}
+
+	if s.config.Method == "" || s.config.Method == "auto" || s.config.Method == "natpmp" {
+		client, err := NewNATPMPClient(s.config.Gateway)
+		if err == nil {
+			// Make sure something answers before settling on NAT-PMP
+			_, err = client.ExternalIP(ctx)
+		}
+		if err == nil {
+			fmt.Printf("PortMap > Using NAT-PMP gateway %s\n", client.Gateway)
+			s.mapper = client
+			return client, nil
+		}
+		errs = append(errs, fmt.Errorf("natpmp: %v", err))
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("unknown port mapping method: %q", s.config.Method)
+	}
+	return nil, fmt.Errorf("no port mapping gateway found: %v", errs)
+}
+
+func (s *Service) resetMapper() {
+	s.mapperMutex.Lock()
+	defer s.mapperMutex.Unlock()
+	s.mapper = nil
+}
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isSharedAddress(ip net.IP) bool {
+	return sharedAddressSpace.Contains(ip)
+}
@@ -0,0 +1,349 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/router"
+)
+
+const igdDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// fakeIGD is a UPnP Internet Gateway Device answering the WANIPConnection actions used by the client
+type fakeIGD struct {
+	*httptest.Server
+	externalIP string
+
+	mutex         sync.Mutex
+	permanentOnly bool                         // answers 725 OnlyPermanentLeasesSupported to leases other than 0
+	mappings      map[string]map[string]string // external port -> arguments of AddPortMapping
+}
+
+func newFakeIGD(t *testing.T, externalIP string) *fakeIGD {
+	igd := &fakeIGD{externalIP: externalIP, mappings: make(map[string]map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = io.WriteString(w, igdDescription)
+	})
+	mux.HandleFunc("POST /ctl/IPConn", igd.control)
+	igd.Server = httptest.NewServer(mux)
+	t.Cleanup(igd.Close)
+	return igd
+}
+
+func (igd *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	serviceType, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `"`), "#")
+	if serviceType != "urn:schemas-upnp-org:service:WANIPConnection:1" {
+		igd.fault(w, 401, "Invalid Action")
+		return
+	}
+	args, err := parseSOAPResponse(r.Body)
+	if err != nil {
+		igd.fault(w, 402, "Invalid Args")
+		return
+	}
+
+	igd.mutex.Lock()
+	defer igd.mutex.Unlock()
+
+	switch action {
+	case "GetExternalIPAddress":
+		igd.respond(w, action, "<NewExternalIPAddress>"+igd.externalIP+"</NewExternalIPAddress>")
+	case "AddPortMapping":
+		if args["NewProtocol"] != "TCP" || args["NewInternalClient"] == "" {
+			igd.fault(w, 402, "Invalid Args")
+			return
+		}
+		if igd.permanentOnly && args["NewLeaseDuration"] != "0" {
+			igd.fault(w, 725, "OnlyPermanentLeasesSupported")
+			return
+		}
+		igd.mappings[args["NewExternalPort"]] = args
+		igd.respond(w, action, "")
+	case "DeletePortMapping":
+		if _, ok := igd.mappings[args["NewExternalPort"]]; !ok {
+			igd.fault(w, 714, "NoSuchEntryInArray")
+			return
+		}
+		delete(igd.mappings, args["NewExternalPort"])
+		igd.respond(w, action, "")
+	default:
+		igd.fault(w, 401, "Invalid Action")
+	}
+}
+
+func (igd *fakeIGD) respond(w http.ResponseWriter, action, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`, action, body, action)
+}
+
+func (igd *fakeIGD) fault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+		`<errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, description)
+}
+
+func (igd *fakeIGD) mapping(port string) map[string]string {
+	igd.mutex.Lock()
+	defer igd.mutex.Unlock()
+	return igd.mappings[port]
+}
+
+func newTestManager(ports ...int) *router.Manager {
+	m := &router.Manager{Routes: &sync.Map{}}
+	for i, port := range ports {
+		routeID := fmt.Sprintf("route%d", i+1)
+		m.Routes.Store(routeID, &router.Route{RouteID: routeID, BindIP: "0.0.0.0", BindPort: port})
+	}
+	return m
+}
+
+func TestUPnPGatewayMapsRoutes(t *testing.T) {
+	igd := newFakeIGD(t, "203.0.113.5")
+	s := NewService(config.PortMappingConfig{Enabled: true, Method: "upnp", GatewayURL: igd.URL + "/rootDesc.xml", Lifetime: 600}, newTestManager(25565, 25570))
+
+	renewIn := s.MapRoutes()
+	if renewIn != 5*time.Minute {
+		t.Errorf("mappings renewed in %v, want half of the lifetime", renewIn)
+	}
+
+	for _, port := range []string{"25565", "25570"} {
+		args := igd.mapping(port)
+		if args == nil {
+			t.Fatalf("port %s was not mapped", port)
+		}
+		if args["NewInternalPort"] != port || args["NewLeaseDuration"] != "600" || args["NewEnabled"] != "1" {
+			t.Errorf("port %s mapped with %v", port, args)
+		}
+		if args["NewInternalClient"] != "127.0.0.1" {
+			t.Errorf("port %s mapped to %s instead of the local address towards the gateway", port, args["NewInternalClient"])
+		}
+	}
+
+	ip, err := s.PublicIP(context.Background())
+	if err != nil || ip != "203.0.113.5" {
+		t.Errorf("PublicIP() = %q, %v, want the WAN address of the gateway", ip, err)
+	}
+}
+
+func TestUPnPMappingsFollowRoutes(t *testing.T) {
+	igd := newFakeIGD(t, "203.0.113.5")
+	m := newTestManager(25565, 25570)
+	s := NewService(config.PortMappingConfig{Enabled: true, Method: "upnp", GatewayURL: igd.URL + "/rootDesc.xml"}, m)
+
+	s.MapRoutes()
+	m.Routes.Delete("route2")
+	s.MapRoutes()
+	if igd.mapping("25570") != nil {
+		t.Error("mapping of a removed route was kept")
+	}
+	if igd.mapping("25565") == nil {
+		t.Error("mapping of a remaining route was deleted")
+	}
+
+	s.Stop()
+	if igd.mapping("25565") != nil {
+		t.Error("mapping kept after Stop")
+	}
+	s.MapRoutes()
+	if igd.mapping("25565") != nil {
+		t.Error("route mapped again after Stop")
+	}
+}
+
+func TestUPnPPermanentLeasesOnly(t *testing.T) {
+	igd := newFakeIGD(t, "203.0.113.5")
+	igd.mutex.Lock()
+	igd.permanentOnly = true
+	igd.mutex.Unlock()
+
+	client, err := NewUPnPClient(context.Background(), igd.URL+"/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted, err := client.AddMapping(context.Background(), Mapping{InternalPort: 25565, ExternalPort: 25565, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if granted != 0 || igd.mapping("25565")["NewLeaseDuration"] != "0" {
+		t.Errorf("expected a permanent mapping after error 725, granted %v", granted)
+	}
+
+	err = client.DeleteMapping(context.Background(), Mapping{InternalPort: 25565, ExternalPort: 25565})
+	if err != nil || igd.mapping("25565") != nil {
+		t.Errorf("mapping not deleted: %v", err)
+	}
+	err = client.DeleteMapping(context.Background(), Mapping{InternalPort: 25565, ExternalPort: 25565})
+	if err == nil || !strings.Contains(err.Error(), "714") {
+		t.Errorf("deleting a missing mapping should report the gateway error, got %v", err)
+	}
+}
+
+func TestUPnPSharedWANAddress(t *testing.T) {
+	igd := newFakeIGD(t, "100.64.12.34")
+	s := NewService(config.PortMappingConfig{Enabled: true, Method: "upnp", GatewayURL: igd.URL + "/rootDesc.xml"}, newTestManager())
+
+	if ip, err := s.PublicIP(context.Background()); err == nil {
+		t.Errorf("PublicIP() = %s, a shared WAN address is not the public IP", ip)
+	}
+	if ip, err := s.WANAddress(context.Background()); err != nil || ip != "100.64.12.34" {
+		t.Errorf("WANAddress() = %q, %v, want the address reported by the gateway", ip, err)
+	}
+}
+
+// fakeNATPMP is a NAT-PMP gateway (RFC 6886) granting at most maxLifetime to mappings
+type fakeNATPMP struct {
+	conn        *net.UDPConn
+	externalIP  net.IP
+	maxLifetime uint32
+
+	mutex      sync.Mutex
+	resultCode uint16            // sent instead of success if not 0
+	mappings   map[uint16]uint16 // internal port -> external port
+}
+
+func newFakeNATPMP(t *testing.T, externalIP string) *fakeNATPMP {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	gateway := &fakeNATPMP{conn: conn, externalIP: net.ParseIP(externalIP).To4(), maxLifetime: 1800, mappings: make(map[uint16]uint16)}
+	go gateway.serve()
+	return gateway
+}
+
+func (g *fakeNATPMP) serve() {
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 || buf[0] != 0 {
+			continue
+		}
+
+		g.mutex.Lock()
+		resultCode := g.resultCode
+		g.mutex.Unlock()
+
+		resp := make([]byte, 8, 16)
+		resp[1] = buf[1] | 0x80
+		binary.BigEndian.PutUint16(resp[2:4], resultCode)
+		binary.BigEndian.PutUint32(resp[4:8], 42) // seconds since the mapping table was reset
+
+		switch {
+		case buf[1] == 0 && n == 2:
+			resp = append(resp, g.externalIP...)
+		case buf[1] == 2 && n == 12:
+			internal := binary.BigEndian.Uint16(buf[4:6])
+			external := binary.BigEndian.Uint16(buf[6:8])
+			lifetime := min(binary.BigEndian.Uint32(buf[8:12]), g.maxLifetime)
+
+			g.mutex.Lock()
+			if lifetime == 0 {
+				delete(g.mappings, internal)
+				external = 0
+			} else if resultCode == 0 {
+				g.mappings[internal] = external
+			}
+			g.mutex.Unlock()
+
+			resp = binary.BigEndian.AppendUint16(resp, internal)
+			resp = binary.BigEndian.AppendUint16(resp, external)
+			resp = binary.BigEndian.AppendUint32(resp, lifetime)
+		default:
+			continue
+		}
+		_, _ = g.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func (g *fakeNATPMP) client() *NATPMPClient {
+	return &NATPMPClient{Gateway: net.IPv4(127, 0, 0, 1), port: g.conn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+func (g *fakeNATPMP) mapping(internal uint16) (uint16, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	external, ok := g.mappings[internal]
+	return external, ok
+}
+
+func TestNATPMPGateway(t *testing.T) {
+	gateway := newFakeNATPMP(t, "198.51.100.20")
+	client := gateway.client()
+	ctx := context.Background()
+
+	ip, err := client.ExternalIP(ctx)
+	if err != nil || ip != "198.51.100.20" {
+		t.Fatalf("ExternalIP() = %q, %v", ip, err)
+	}
+
+	granted, err := client.AddMapping(ctx, Mapping{InternalPort: 25565, ExternalPort: 25565, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if granted != 30*time.Minute {
+		t.Errorf("granted lifetime %v, want the one of the gateway", granted)
+	}
+	if external, ok := gateway.mapping(25565); !ok || external != 25565 {
+		t.Errorf("gateway mapping of 25565 is %d (%v)", external, ok)
+	}
+
+	err = client.DeleteMapping(ctx, Mapping{InternalPort: 25565, ExternalPort: 25565})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gateway.mapping(25565); ok {
+		t.Error("mapping not deleted")
+	}
+}
+
+func TestNATPMPGatewayRefusal(t *testing.T) {
+	gateway := newFakeNATPMP(t, "198.51.100.20")
+	gateway.mutex.Lock()
+	gateway.resultCode = 2 // not authorized
+	gateway.mutex.Unlock()
+
+	_, err := gateway.client().AddMapping(context.Background(), Mapping{InternalPort: 25565, ExternalPort: 25565, Lifetime: time.Hour})
+	if err == nil || !strings.Contains(err.Error(), "result code 2") {
+		t.Errorf("expected the refusal of the gateway, got %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ssdpAddress = "239.255.255.250:1900"
+
+var igdSearchTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+// Services able to manage port mappings, in order of preference
+var wanServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnPClient controls the WAN connection service of an Internet Gateway Device
+type UPnPClient struct {
+	ControlURL  string
+	ServiceType string
+	LocalIP     net.IP // our address as seen by the gateway, used as the mapping target
+	httpClient  *http.Client
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// DiscoverUPnP looks for an Internet Gateway Device on the local network with SSDP
+func DiscoverUPnP(ctx context.Context) (*UPnPClient, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSDP socket: %v", err)
+	}
+	defer conn.Close()
+
+	target, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range igdSearchTargets {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddress + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + st + "\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(search), target); err != nil {
+			return nil, fmt.Errorf("failed to send SSDP search: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no UPnP gateway answered: %v", err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+
+		client, err := NewUPnPClient(ctx, location)
+		if err != nil {
+			fmt.Printf("PortMap > Ignoring UPnP device at %s: %v\n", location, err)
+			continue
+		}
+		return client, nil
+	}
+}
+
+// NewUPnPClient reads the device description at descriptionURL and finds its WAN connection service.
+// It can be used directly to skip SSDP when the gateway (or a fake one) is known.
+func NewUPnPClient(ctx context.Context, descriptionURL string) (*UPnPClient, error) {
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", descriptionURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch device description: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("failed to parse device description: %v", err)
+	}
+
+	var service *upnpService
+	for _, serviceType := range wanServiceTypes {
+		if service = findService(&root.Device, serviceType); service != nil {
+			break
+		}
+	}
+	if service == nil {
+		return nil, fmt.Errorf("device has no WAN connection service")
+	}
+
+	base := descriptionURL
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %s: %v", base, err)
+	}
+	controlURL, err := baseURL.Parse(service.ControlURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control URL %s: %v", service.ControlURL, err)
+	}
+
+	localIP, err := localIPFor(controlURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UPnPClient{
+		ControlURL:  controlURL.String(),
+		ServiceType: service.ServiceType,
+		LocalIP:     localIP,
+		httpClient:  httpClient,
+	}, nil
+}
+
+func findService(device *upnpDevice, serviceType string) *upnpService {
+	for i := range device.Services {
+		if device.Services[i].ServiceType == serviceType {
+			return &device.Services[i]
+		}
+	}
+	for i := range device.Devices {
+		if service := findService(&device.Devices[i], serviceType); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
+func (c *UPnPClient) Name() string {
+	return "upnp"
+}
+
+func (c *UPnPClient) ExternalIP(ctx context.Context) (string, error) {
+	values, err := c.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return "", err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(values["NewExternalIPAddress"]))
+	if ip == nil {
+		return "", fmt.Errorf("gateway returned an invalid external IP: %q", values["NewExternalIPAddress"])
+	}
+	return ip.String(), nil
+}
+
+func (c *UPnPClient) AddMapping(ctx context.Context, mapping Mapping) (time.Duration, error) {
+	lease := int(mapping.Lifetime.Seconds())
+	args := [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(mapping.ExternalPort)},
+		{"NewProtocol", "TCP"},
+		{"NewInternalPort", strconv.Itoa(mapping.InternalPort)},
+		{"NewInternalClient", c.LocalIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", mapping.Description},
+		{"NewLeaseDuration", strconv.Itoa(lease)},
+	}
+
+	_, err := c.call(ctx, "AddPortMapping", args)
+	if err != nil && strings.Contains(err.Error(), "725") {
+		// OnlyPermanentLeasesSupported, common on older routers
+		args[7][1] = "0"
+		_, err = c.call(ctx, "AddPortMapping", args)
+		return 0, err
+	}
+	return mapping.Lifetime, err
+}
+
+func (c *UPnPClient) DeleteMapping(ctx context.Context, mapping Mapping) error {
+	_, err := c.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(mapping.ExternalPort)},
+		{"NewProtocol", "TCP"},
+	})
+	return err
+}
+
+// call performs a SOAP action and returns the leaf elements of the response
+func (c *UPnPClient) call(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + c.ServiceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		_ = xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.ControlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+c.ServiceType+"#"+action+`"`)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	values, err := parseSOAPResponse(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s response: %v", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed with status %d: error %s %s", action, resp.StatusCode, values["errorCode"], values["errorDescription"])
+	}
+	return values, nil
+}
+
+func parseSOAPResponse(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+	var current string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			current = t.Name.Local
+		case xml.CharData:
+			if current != "" {
+				values[current] += string(t)
+			}
+		case xml.EndElement:
+			current = ""
+		}
+	}
+}
+
+// localIPFor returns the local address used to reach the given host:port
+func localIPFor(hostPort string) (net.IP, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = hostPort, "80"
+	}
+	conn, err := net.Dial("udp4", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find local address towards %s: %v", host, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
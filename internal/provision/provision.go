@@ -0,0 +1,304 @@
+package provision
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"tunnelled/internal/config"
+	"tunnelled/internal/control"
+	"tunnelled/internal/events"
+	"tunnelled/internal/net"
+	"tunnelled/internal/router"
+)
+
+// RouteSpec is a client route requested by a server
+type RouteSpec struct {
+	RouteID     string                `json:"route_id"`
+	ServerRoute string                `json:"server_route"`
+	BindIP      string                `json:"bind_ip"`
+	BindPort    int                   `json:"bind_port"`
+	HAProxy     router.HAProxyVersion `json:"ha_proxy"`
+	BackendPort int                   `json:"backend_port"` // public port of the server route
+	Metadata    map[string]string     `json:"metadata,omitempty"`
+}
+
+// SyncRequest is the complete set of routes a server wants on the client, routes missing from it are withdrawn
+type SyncRequest struct {
+	IP     string      `json:"ip"` // public IP of the server, the backend of the routes
+	Routes []RouteSpec `json:"routes"`
+}
+
+type SyncResponse struct {
+	Created   []string `json:"created,omitempty"`
+	Updated   []string `json:"updated,omitempty"`
+	Withdrawn []string `json:"withdrawn,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// Provisioner creates, updates and removes the client routes of servers, within their policy
+type Provisioner struct {
+	manager  *router.Manager
+	policies map[string]config.ProvisioningPolicy
+
+	syncMutex sync.Mutex
+}
+
+func NewProvisioner(manager *router.Manager, policies map[string]config.ProvisioningPolicy) *Provisioner {
+	return &Provisioner{
+		manager:  manager,
+		policies: policies,
+	}
+}
+
+// Register answers the route syncs sent over the control channel
+func (p *Provisioner) Register(listener *control.Listener) {
+	listener.Handle(control.TypeRouteSync, func(server string, payload json.RawMessage) (any, error) {
+		var req SyncRequest
+		err := json.Unmarshal(payload, &req)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route sync: %v", err)
+		}
+		return p.Sync(server, req)
+	})
+}
+
+// Sync applies the routes requested by a server. Rejected routes are reported in the response errors,
+// the others are applied anyway.
+func (p *Provisioner) Sync(server string, req SyncRequest) (*SyncResponse, error) {
+	p.syncMutex.Lock()
+	defer p.syncMutex.Unlock()
+
+	resp := &SyncResponse{}
+	wanted := make(map[string]bool)
+
+	// Every server syncs, even those not provisioning anything. Without a policy, every route is rejected
+	// and the ones provisioned before are withdrawn.
+	// The policy of a server only applies with its own token, anyone holding the shared token could claim its name
+	policy, allowed := p.policies[server]
+	if !allowed && len(req.Routes) > 0 {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("server %s is not allowed to provision routes", server))
+		req.Routes = nil
+	} else if policy.Token == "" && len(req.Routes) > 0 {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("server %s has no token of its own in the provisioning policy", server))
+		req.Routes = nil
+	}
+
+	for _, spec := range req.Routes {
+		changed, created, err := p.apply(server, policy, req.IP, spec)
+		if err != nil {
+			// a rejected route is not provisioned, even if it was accepted before
+			fmt.Printf("Provision > Rejected route %s of server %s: %v\n", spec.RouteID, server, err)
+			resp.Errors = append(resp.Errors, fmt.Sprintf("route %s: %v", spec.RouteID, err))
+			continue
+		}
+		wanted[spec.RouteID] = true
+		if created {
+			resp.Created = append(resp.Created, spec.RouteID)
+		} else if changed {
+			resp.Updated = append(resp.Updated, spec.RouteID)
+		}
+	}
+
+	for _, route := range p.ownedRoutes(server) {
+		if !wanted[route.RouteID] {
+			p.withdraw(route)
+			resp.Withdrawn = append(resp.Withdrawn, route.RouteID)
+		}
+	}
+
+	if len(resp.Created)+len(resp.Updated)+len(resp.Withdrawn) > 0 {
+		err := p.manager.SaveRoutesToFile()
+		if err != nil {
+			return nil, fmt.Errorf("failed to save routes: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// apply creates or updates a single route, it reports whether the route changed and whether it's new
+func (p *Provisioner) apply(server string, policy config.ProvisioningPolicy, ip string, spec RouteSpec) (bool, bool, error) {
+	err := p.validate(server, policy, spec)
+	if err != nil {
+		return false, false, err
+	}
+
+	route, exists := p.manager.GetRoute(spec.RouteID)
+	if !exists {
+		if ip == "" {
+			return false, false, errors.New("the server has no public IP yet, the route is created with the first IP update")
+		}
+		route = &router.Route{
+			RouteID:     spec.RouteID,
+			BindIP:      spec.BindIP,
+			BindPort:    spec.BindPort,
+			HAProxy:     spec.HAProxy,
+			BackendIP:   ip,
+			BackendPort: spec.BackendPort,
+			Link:        &router.RouteLink{Server: server, Route: spec.ServerRoute},
+			Owner:       server,
+			Metadata:    spec.Metadata,
+		}
+		// Provisioned routes go through the same checks as the routes file
+		err = route.Validate()
+		if err != nil {
+			return false, false, err
+		}
+		p.manager.AddRoute(route)
+		net.StartListener(route, false)
+
+		fmt.Printf("Provision > Server %s created route %s on %s:%d\n", server, route.RouteID, route.BindIP, route.BindPort)
+		events.Publish(events.Event{
+			Type:    events.RouteProvisioned,
+			RouteID: route.RouteID,
+			Data:    map[string]any{"server": server, "bind_ip": route.BindIP, "bind_port": route.BindPort},
+		})
+		return true, true, nil
+	}
+
+	changed := false
+	if route.BindIP != spec.BindIP || route.BindPort != spec.BindPort || route.HAProxy != spec.HAProxy {
+		candidate := *route
+		candidate.BindIP, candidate.BindPort, candidate.HAProxy = spec.BindIP, spec.BindPort, spec.HAProxy
+		err = candidate.Validate()
+		if err != nil {
+			return false, false, err
+		}
+
+		// the listener is bound to the old address, it's replaced
+		err = net.StopListener(route.RouteID)
+		if err != nil {
+			fmt.Printf("Provision > %v\n", err)
+		}
+		route.BindIP = spec.BindIP
+		route.BindPort = spec.BindPort
+		route.HAProxy = spec.HAProxy
+		net.StartListener(route, false)
+		changed = true
+	}
+	if route.Link == nil || route.Link.Route != spec.ServerRoute {
+		route.Link = &router.RouteLink{Server: server, Route: spec.ServerRoute}
+		changed = true
+	}
+	if ip != "" && p.manager.UpdateBackend(route, ip, spec.BackendPort) {
+		changed = true
+	}
+	if !mapsEqual(route.Metadata, spec.Metadata) {
+		route.Metadata = spec.Metadata
+		changed = true
+	}
+	return changed, false, nil
+}
+
+// validate checks a route against the policy of its server and the other routes
+func (p *Provisioner) validate(server string, policy config.ProvisioningPolicy, spec RouteSpec) error {
+	if spec.RouteID == "" || spec.ServerRoute == "" {
+		return errors.New("route_id and server_route are required")
+	}
+	if spec.BackendPort <= 0 || spec.BackendPort > 65535 {
+		return fmt.Errorf("invalid backend port %d", spec.BackendPort)
+	}
+	switch spec.HAProxy {
+	case router.HAProxyOFF, router.HAProxyV1, router.HAProxyV2:
+	default:
+		return fmt.Errorf("invalid ha_proxy %s", spec.HAProxy)
+	}
+
+	allowed, err := portAllowed(policy.Ports, spec.BindPort)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("port %d is not allowed for server %s", spec.BindPort, server)
+	}
+	if len(policy.BindIPs) > 0 && !slices.Contains(policy.BindIPs, spec.BindIP) {
+		return fmt.Errorf("bind address %s is not allowed for server %s", spec.BindIP, server)
+	}
+
+	var conflict error
+	p.manager.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*router.Route)
+		if !ok {
+			return true
+		}
+		if route.RouteID == spec.RouteID && route.Owner != server {
+			conflict = fmt.Errorf("route %s already exists and is not owned by server %s", spec.RouteID, server)
+			return false
+		}
+		if route.RouteID != spec.RouteID && route.BindPort == spec.BindPort && (route.BindIP == spec.BindIP || isWildcard(route.BindIP) || isWildcard(spec.BindIP)) {
+			conflict = fmt.Errorf("port %d is already used by route %s", spec.BindPort, route.RouteID)
+			return false
+		}
+		return true
+	})
+	return conflict
+}
+
+func (p *Provisioner) withdraw(route *router.Route) {
+	err := net.StopListener(route.RouteID)
+	if err != nil {
+		fmt.Printf("Provision > %v\n", err)
+	}
+	p.manager.RemoveRoute(route.RouteID)
+
+	fmt.Printf("Provision > Server %s withdrew route %s\n", route.Owner, route.RouteID)
+	events.Publish(events.Event{
+		Type:    events.RouteWithdrawn,
+		RouteID: route.RouteID,
+		Data:    map[string]any{"server": route.Owner},
+	})
+}
+
+// ownedRoutes returns the routes provisioned by a server
+func (p *Provisioner) ownedRoutes(server string) []*router.Route {
+	var routes []*router.Route
+	p.manager.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*router.Route)
+		if ok && route.Owner == server {
+			routes = append(routes, route)
+		}
+		return true
+	})
+	return routes
+}
+
+// portAllowed checks a port against a list of ports and ranges like 25565-25570
+func portAllowed(allowed []string, port int) (bool, error) {
+	for _, entry := range allowed {
+		low, high, isRange := strings.Cut(entry, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(low))
+		if err != nil {
+			return false, fmt.Errorf("invalid allowed port %s", entry)
+		}
+		to := from
+		if isRange {
+			to, err = strconv.Atoi(strings.TrimSpace(high))
+			if err != nil {
+				return false, fmt.Errorf("invalid allowed port range %s", entry)
+			}
+		}
+		if port >= from && port <= to {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isWildcard(ip string) bool {
+	return ip == "" || ip == "0.0.0.0" || ip == "::"
+}
+
+func mapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
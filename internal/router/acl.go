@@ -0,0 +1,134 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"tunnelled/internal/util"
+)
+
+// ACL filters the players of a route by their effective IP (after PROXY parsing), deny wins over allow
+type ACL struct {
+	Allow []string `json:"allow,omitempty"` // everyone if empty
+	Deny  []string `json:"deny,omitempty"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func NewACL(allow, deny []string) (*ACL, error) {
+	acl := &ACL{Allow: allow, Deny: deny}
+	for _, entry := range allow {
+		network, err := util.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed range: %v", err)
+		}
+		acl.allow = append(acl.allow, network)
+	}
+	for _, entry := range deny {
+		network, err := util.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied range: %v", err)
+		}
+		acl.deny = append(acl.deny, network)
+	}
+	return acl, nil
+}
+
+func (a *ACL) UnmarshalJSON(data []byte) error {
+	var lists struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	err := json.Unmarshal(data, &lists)
+	if err != nil {
+		return err
+	}
+
+	acl, err := NewACL(lists.Allow, lists.Deny)
+	if err != nil {
+		return err
+	}
+	*a = *acl
+	return nil
+}
+
+// Permits reports whether a player IP may use the route, a nil ACL permits everyone
+func (a *ACL) Permits(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return len(a.allow) == 0
+	}
+	for _, network := range a.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, network := range a.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentACL returns the ACL of the route, nil if it has none
+func (r *Route) CurrentACL() *ACL {
+	routeMutex.RLock()
+	defer routeMutex.RUnlock()
+	return r.ACL
+}
+
+// SetACL replaces the ACL of a route, nil removes it. The routes file is not saved.
+func (m *Manager) SetACL(route *Route, acl *ACL) {
+	routeMutex.Lock()
+	route.ACL = acl
+	routeMutex.Unlock()
+	fmt.Printf("Updated ACL of route %s\n", route.RouteID)
+}
+
+// ReloadACLs reads the ACLs of the running routes again from the routes file, it returns the reloaded routes.
+// Only the ACLs are read, the routes themselves are the ones of the manager and routes missing from the file
+// keep their ACL.
+func (m *Manager) ReloadACLs() ([]string, error) {
+	data, err := os.ReadFile(routesFile)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		RouteID string `json:"route_id"`
+		ACL     *ACL   `json:"acl"`
+	}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the ACLs of the routes file: %v", err)
+	}
+	acls := make(map[string]*ACL, len(entries))
+	for _, entry := range entries {
+		acls[entry.RouteID] = entry.ACL
+	}
+
+	var reloaded []string
+	m.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*Route)
+		if !ok {
+			return true
+		}
+		acl, listed := acls[route.RouteID]
+		if !listed {
+			return true
+		}
+		m.SetACL(route, acl)
+		reloaded = append(reloaded, route.RouteID)
+		return true
+	})
+	slices.Sort(reloaded)
+	return reloaded, nil
+}
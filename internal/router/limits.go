@@ -0,0 +1,62 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// RateLimit is a token bucket of new connections
+type RateLimit struct {
+	Rate  float64 `json:"rate"`            // new connections per second
+	Burst int     `json:"burst,omitempty"` // connections allowed at once, the rate rounded up if 0
+}
+
+// Capacity returns the size of the bucket
+func (r *RateLimit) Capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.Rate))
+}
+
+func (r *RateLimit) validate() error {
+	if r.Rate <= 0 {
+		return errors.New("rate must be positive")
+	}
+	if r.Burst < 0 {
+		return errors.New("burst cannot be negative")
+	}
+	return nil
+}
+
+// Limits protect a client route from connection floods, players over a limit are refused before the tunnel is dialed
+type Limits struct {
+	PerIP     *RateLimit `json:"per_ip,omitempty"`
+	PerPrefix *RateLimit `json:"per_prefix,omitempty"` // per /24 for IPv4 and /64 for IPv6
+	PerRoute  *RateLimit `json:"per_route,omitempty"`
+
+	// Concurrent connections, unlimited if 0
+	MaxConnections      int `json:"max_connections,omitempty"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+
+	// Message is the Minecraft disconnect message of refused players, they're disconnected without one if empty
+	Message string `json:"message,omitempty"`
+}
+
+// Validate checks the limits of a route
+func (l *Limits) Validate() error {
+	buckets := map[string]*RateLimit{"per_ip": l.PerIP, "per_prefix": l.PerPrefix, "per_route": l.PerRoute}
+	for name, bucket := range buckets {
+		if bucket == nil {
+			continue
+		}
+		if err := bucket.validate(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if l.MaxConnections < 0 || l.MaxConnectionsPerIP < 0 {
+		return errors.New("connection caps cannot be negative")
+	}
+	return nil
+}
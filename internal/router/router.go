@@ -3,14 +3,29 @@ package router
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"os"
+	"runtime"
+	"slices"
 	"sync"
+	"time"
+	"tunnelled/internal/events"
+	"tunnelled/internal/haproxy"
+	"tunnelled/internal/util"
 )
 
 type Manager struct {
 	Routes *sync.Map
+
+	backendListeners      []func(route *Route)
+	routeListeners        []func(route *Route, removed bool)
+	backendListenersMutex sync.RWMutex
 }
 
+// Guards the backend and the ACL of every route, rewritten by the API, IP updates and DNS while the gnet loops read them
+var routeMutex sync.RWMutex
+
 var routesFile = "routes.json"
 
 func NewManager() *Manager {
@@ -30,10 +45,13 @@ func NewManager() *Manager {
 	err = json.Unmarshal(data, &routes)
 	if err != nil {
 		panic(errors.Join(errors.New("cannot unmarshal routes file"), err))
-		return m
 	}
 
 	for _, route := range routes {
+		err = route.Validate()
+		if err != nil {
+			panic(err)
+		}
 		m.Routes.Store(route.RouteID, route)
 	}
 
@@ -63,7 +81,9 @@ func (m *Manager) SaveRoutesToFile() error {
 		return true
 	})
 
+	routeMutex.RLock()
 	data, err := json.MarshalIndent(routes, "", "  ")
+	routeMutex.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -79,13 +99,343 @@ const (
 	HAProxyOFF HAProxyVersion = "off"
 )
 
+type InboundMode string
+
+const (
+	InboundOff      InboundMode = "off"      // PROXY headers are not parsed, they're forwarded as payload
+	InboundOptional InboundMode = "optional" // a PROXY header is parsed if present
+	InboundRequired InboundMode = "required" // connections without a PROXY header are closed
+)
+
+// UntrustedAction is what happens to the PROXY header of a peer outside of the trusted proxies
+type UntrustedAction string
+
+const (
+	UntrustedReject  UntrustedAction = "reject"  // the connection is closed
+	UntrustedPayload UntrustedAction = "payload" // the header isn't parsed, it's forwarded as payload
+)
+
+type InboundProxy struct {
+	Mode     InboundMode `json:"mode"`
+	Versions []int       `json:"versions,omitempty"` // accepted versions (1 and/or 2), both if empty
+
+	// TrustedProxies are the IPs and CIDRs allowed to send PROXY headers, every peer if empty
+	TrustedProxies []string        `json:"trusted_proxies,omitempty"`
+	Untrusted      UntrustedAction `json:"untrusted,omitempty"` // reject by default
+
+	// HeaderTimeout is how long a peer has to send its complete header, in seconds
+	HeaderTimeout int `json:"header_timeout,omitempty"`
+
+	trusted []*net.IPNet // TrustedProxies, parsed when the route is validated
+}
+
+// DefaultHeaderTimeout applies to routes without a header_timeout
+const DefaultHeaderTimeout = 5 * time.Second
+
+// HeaderDeadline returns how long a peer has to send its complete PROXY header
+func (p InboundProxy) HeaderDeadline() time.Duration {
+	if p.HeaderTimeout <= 0 {
+		return DefaultHeaderTimeout
+	}
+	return time.Duration(p.HeaderTimeout) * time.Second
+}
+
+// Accepts reports whether a PROXY header of the given version is accepted
+func (p InboundProxy) Accepts(version int) bool {
+	return len(p.Versions) == 0 || slices.Contains(p.Versions, version)
+}
+
+// Trusts reports whether a peer is allowed to send PROXY headers, the route must have been validated
+func (p InboundProxy) Trusts(ip net.IP) bool {
+	if len(p.TrustedProxies) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type OutboundProxy struct {
+	Version HAProxyVersion `json:"version"`        // off, v1 or v2
+	TLVs    []string       `json:"tlvs,omitempty"` // v2 TLVs to include, by name or number
+}
+
 type Route struct {
 	RouteID  string `json:"route_id"`
 	BindIP   string `json:"bind_ip"`
 	BindPort int    `json:"bind_port"`
 
-	HAProxy HAProxyVersion `json:"ha_proxy"`
+	HAProxy HAProxyVersion `json:"ha_proxy"` // legacy, both directions, overridden by proxy_inbound and proxy_outbound
+
+	// Inbound is which PROXY headers the client accepts from its peers,
+	// Outbound is the PROXY header the server sends to its backend
+	Inbound  *InboundProxy  `json:"proxy_inbound,omitempty"`
+	Outbound *OutboundProxy `json:"proxy_outbound,omitempty"`
+
+	// Transparent makes the server connect to the backend from the player IP (Linux only)
+	Transparent bool `json:"transparent,omitempty"`
+
+	// ACL filters the players of a client route before the tunnel is dialed
+	ACL *ACL `json:"acl,omitempty"`
+	// Limits refuse the players of a client route flooding it with connections
+	Limits *Limits `json:"limits,omitempty"`
 
 	BackendIP   string `json:"backend_ip"`
 	BackendPort int    `json:"backend_port"`
+
+	// BackendHost is followed through DNS by the client, BackendIP then holds its current address
+	BackendHost string `json:"backend_host,omitempty"`
+
+	// Link ties a client route to the server route it tunnels to, IP updates are applied through it
+	Link *RouteLink `json:"link,omitempty"`
+
+	// Owner is the server that provisioned this route on the client, empty for routes written by hand
+	Owner    string            `json:"owner,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type RouteLink struct {
+	Server string `json:"server"` // name of the tunnelled-server
+	Route  string `json:"route"`  // route ID on that server
+}
+
+// InboundProxy returns the PROXY headers accepted by the route, the legacy ha_proxy field
+// means an optional header of any version
+func (r *Route) InboundProxy() InboundProxy {
+	if r.Inbound != nil {
+		return *r.Inbound
+	}
+	if r.HAProxy != "" && r.HAProxy != HAProxyOFF {
+		return InboundProxy{Mode: InboundOptional}
+	}
+	return InboundProxy{Mode: InboundOff}
+}
+
+// OutboundProxy returns the PROXY header sent to the backend of the route
+func (r *Route) OutboundProxy() OutboundProxy {
+	if r.Outbound != nil {
+		return *r.Outbound
+	}
+	if r.HAProxy == "" {
+		return OutboundProxy{Version: HAProxyOFF}
+	}
+	return OutboundProxy{Version: r.HAProxy}
+}
+
+// Validate checks the PROXY protocol settings of the route and parses its trusted proxies
+func (r *Route) Validate() error {
+	switch r.HAProxy {
+	case "", HAProxyOFF, HAProxyV1, HAProxyV2:
+	default:
+		return fmt.Errorf("route %s: invalid ha_proxy %s", r.RouteID, r.HAProxy)
+	}
+
+	if r.Transparent && runtime.GOOS != "linux" {
+		return fmt.Errorf("route %s: transparent mode is only supported on Linux", r.RouteID)
+	}
+
+	if r.Limits != nil {
+		if err := r.Limits.Validate(); err != nil {
+			return fmt.Errorf("route %s: invalid limits: %v", r.RouteID, err)
+		}
+	}
+
+	inbound := r.InboundProxy()
+	switch inbound.Mode {
+	case InboundOff, InboundOptional, InboundRequired:
+	default:
+		return fmt.Errorf("route %s: invalid inbound PROXY mode %s", r.RouteID, inbound.Mode)
+	}
+	for _, version := range inbound.Versions {
+		if version != 1 && version != 2 {
+			return fmt.Errorf("route %s: invalid inbound PROXY version %d", r.RouteID, version)
+		}
+	}
+	var trusted []*net.IPNet
+	for _, entry := range inbound.TrustedProxies {
+		network, err := util.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("route %s: invalid trusted proxy: %v", r.RouteID, err)
+		}
+		trusted = append(trusted, network)
+	}
+	if r.Inbound != nil {
+		r.Inbound.trusted = trusted
+	}
+	switch inbound.Untrusted {
+	case "", UntrustedReject, UntrustedPayload:
+	default:
+		return fmt.Errorf("route %s: invalid untrusted PROXY action %s", r.RouteID, inbound.Untrusted)
+	}
+
+	outbound := r.OutboundProxy()
+	switch outbound.Version {
+	case HAProxyOFF, HAProxyV1, HAProxyV2:
+	default:
+		return fmt.Errorf("route %s: invalid outbound PROXY version %s", r.RouteID, outbound.Version)
+	}
+	if len(outbound.TLVs) > 0 && outbound.Version != HAProxyV2 {
+		return fmt.Errorf("route %s: TLVs can only be sent with PROXY v2", r.RouteID)
+	}
+	for _, tlv := range outbound.TLVs {
+		if _, err := haproxy.ParseTLVName(tlv); err != nil {
+			return fmt.Errorf("route %s: %v", r.RouteID, err)
+		}
+	}
+	return nil
+}
+
+// Backend returns the current backend address of the route
+func (r *Route) Backend() (string, int) {
+	routeMutex.RLock()
+	defer routeMutex.RUnlock()
+	return r.BackendIP, r.BackendPort
+}
+
+// BackendHostname returns the hostname the backend follows through DNS, empty if it doesn't
+func (r *Route) BackendHostname() string {
+	routeMutex.RLock()
+	defer routeMutex.RUnlock()
+	return r.BackendHost
+}
+
+// GetRoute returns the route with the given ID
+func (m *Manager) GetRoute(routeID string) (*Route, bool) {
+	value, ok := m.Routes.Load(routeID)
+	if !ok {
+		return nil, false
+	}
+	route, ok := value.(*Route)
+	return route, ok
+}
+
+// LinkedRoutes returns the routes linked to the given server
+func (m *Manager) LinkedRoutes(server string) []*Route {
+	var routes []*Route
+	m.Routes.Range(func(key, value any) bool {
+		route, ok := value.(*Route)
+		if ok && route.Link != nil && route.Link.Server == server {
+			routes = append(routes, route)
+		}
+		return true
+	})
+	return routes
+}
+
+// AddBackendListener registers a function called (in its own goroutine) every time a route backend changes
+func (m *Manager) AddBackendListener(listener func(route *Route)) {
+	m.backendListenersMutex.Lock()
+	defer m.backendListenersMutex.Unlock()
+	m.backendListeners = append(m.backendListeners, listener)
+}
+
+// AddRouteListener registers a function called every time a route is added to or removed from the manager
+func (m *Manager) AddRouteListener(listener func(route *Route, removed bool)) {
+	m.backendListenersMutex.Lock()
+	defer m.backendListenersMutex.Unlock()
+	m.routeListeners = append(m.routeListeners, listener)
+}
+
+// AddRoute stores a route created at runtime, its listener is not started
+func (m *Manager) AddRoute(route *Route) {
+	m.Routes.Store(route.RouteID, route)
+	m.notifyRouteListeners(route, false)
+}
+
+// RemoveRoute forgets a route, its listener is not stopped
+func (m *Manager) RemoveRoute(routeID string) {
+	value, loaded := m.Routes.LoadAndDelete(routeID)
+	if route, ok := value.(*Route); loaded && ok {
+		m.notifyRouteListeners(route, true)
+	}
+}
+
+func (m *Manager) notifyRouteListeners(route *Route, removed bool) {
+	m.backendListenersMutex.RLock()
+	defer m.backendListenersMutex.RUnlock()
+	for _, listener := range m.routeListeners {
+		listener(route, removed)
+	}
+}
+
+// SetBackendHost makes a route follow a hostname through DNS, empty to stop following it
+func (m *Manager) SetBackendHost(route *Route, host string) {
+	routeMutex.Lock()
+	defer routeMutex.Unlock()
+	route.BackendHost = host
+}
+
+// UpdateBackend points a route to a new backend address, a port of 0 keeps the current one.
+// It reports whether anything changed, the routes file is not saved.
+func (m *Manager) UpdateBackend(route *Route, ip string, port int) bool {
+	routeMutex.Lock()
+	if port == 0 {
+		port = route.BackendPort
+	}
+	if route.BackendIP == ip && route.BackendPort == port {
+		routeMutex.Unlock()
+		return false
+	}
+
+	oldIP, oldPort := route.BackendIP, route.BackendPort
+	route.BackendIP = ip
+	route.BackendPort = port
+	routeMutex.Unlock()
+	fmt.Printf("Updated route %s backend to %s:%d\n", route.RouteID, ip, port)
+
+	events.Publish(events.Event{
+		Type:    events.RouteUpdated,
+		RouteID: route.RouteID,
+		Data: map[string]any{
+			"old_backend_ip":   oldIP,
+			"old_backend_port": oldPort,
+			"backend_ip":       ip,
+			"backend_port":     port,
+		},
+	})
+
+	m.backendListenersMutex.RLock()
+	defer m.backendListenersMutex.RUnlock()
+	for _, listener := range m.backendListeners {
+		go listener(route)
+	}
+	return true
+}
+
+// ApplyLinkedUpdate applies a backend update sent by a server to the routes linked to it.
+// serverRoutes maps the server route IDs to their public port (0 to keep the current one).
+// Linked routes targeting a route the server didn't send are errors. The server routes nobody links to are
+// returned apart, a client may well tunnel only some of them.
+func (m *Manager) ApplyLinkedUpdate(server, ip string, serverRoutes map[string]int) ([]string, []string, []error) {
+	var updated, unlinked []string
+	var errs []error
+
+	linked := make(map[string]bool)
+	for _, route := range m.LinkedRoutes(server) {
+		port, ok := serverRoutes[route.Link.Route]
+		if !ok {
+			errs = append(errs, fmt.Errorf("route %s is linked to %s/%s, which the server did not send", route.RouteID, server, route.Link.Route))
+			continue
+		}
+		linked[route.Link.Route] = true
+
+		if m.UpdateBackend(route, ip, port) {
+			updated = append(updated, route.RouteID)
+		}
+	}
+
+	for serverRoute := range serverRoutes {
+		if !linked[serverRoute] {
+			unlinked = append(unlinked, serverRoute)
+		}
+	}
+	slices.Sort(unlinked)
+
+	return updated, unlinked, errs
 }
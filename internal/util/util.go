@@ -1,6 +1,11 @@
 package util
 
-import "sync"
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
 
 func LenSyncMap(m *sync.Map) int {
 	var i int
@@ -10,3 +15,21 @@ func LenSyncMap(m *sync.Map) int {
 	})
 	return i
 }
+
+// ParseCIDR parses a CIDR, a single IP is a network of its own
+func ParseCIDR(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %s", entry)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"tunnelled/internal/config"
+	"tunnelled/internal/events"
+	"tunnelled/internal/metrics"
+)
+
+const (
+	defaultMaxRetries = 5
+	defaultTimeout    = 10 * time.Second
+	maxRetryDelay     = 5 * time.Minute
+
+	// Deliveries waiting for the endpoint, retries included. Events are dropped when it's full.
+	queueSize = 1024
+)
+
+type Webhook struct {
+	config     config.WebhookConfig
+	template   *template.Template
+	httpClient *http.Client
+	stream     <-chan events.Event
+
+	queue    chan delivery
+	dropping atomic.Bool // a drop was logged, the next ones are only counted until an event is queued again
+}
+
+// delivery is an event waiting to be sent, attempt counts the failed attempts
+type delivery struct {
+	event   events.Event
+	body    []byte
+	attempt int
+}
+
+var templateFuncs = template.FuncMap{
+	// json encodes a value, useful to safely embed strings in JSON bodies: {"content": {{json .Data.new_ip}}}
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// Start subscribes every configured webhook to the event bus
+func Start(configs []config.WebhookConfig) error {
+	for i, cfg := range configs {
+		hook, err := NewWebhook(cfg)
+		if err != nil {
+			return fmt.Errorf("invalid webhook #%d: %v", i+1, err)
+		}
+		hook.Subscribe()
+		go hook.Run()
+	}
+
+	if len(configs) > 0 {
+		fmt.Printf("Webhooks > Started %d webhooks\n", len(configs))
+	}
+	return nil
+}
+
+func NewWebhook(cfg config.WebhookConfig) (*Webhook, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("missing url")
+	}
+	for _, t := range cfg.Events {
+		if !events.Known(events.Type(t)) {
+			return nil, fmt.Errorf("unknown event %q", t)
+		}
+	}
+
+	hook := &Webhook{
+		config: cfg,
+		httpClient: &http.Client{
+			Timeout: defaultTimeout,
+		},
+		queue: make(chan delivery, queueSize),
+	}
+	if cfg.Timeout > 0 {
+		hook.httpClient.Timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	if hook.config.MaxRetries <= 0 {
+		hook.config.MaxRetries = defaultMaxRetries
+	}
+
+	if cfg.Template != "" {
+		tmpl, err := template.New(cfg.URL).Funcs(templateFuncs).Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template: %v", err)
+		}
+		hook.template = tmpl
+	}
+
+	return hook, nil
+}
+
+// Subscribe registers the webhook on the event bus, events published from now on are buffered for Run
+func (w *Webhook) Subscribe() {
+	types := make([]events.Type, 0, len(w.config.Events))
+	for _, t := range w.config.Events {
+		types = append(types, events.Type(t))
+	}
+
+	w.stream, _ = events.Subscribe(256, types...)
+}
+
+// Run delivers the subscribed events one at a time, it never returns. The subscription is drained right away
+// into the delivery queue, and failed deliveries are queued again after their backoff instead of holding it.
+func (w *Webhook) Run() {
+	go func() {
+		for d := range w.queue {
+			w.attempt(d)
+		}
+	}()
+
+	for event := range w.stream {
+		body, err := w.render(event)
+		if err != nil {
+			fmt.Printf("Webhooks > Failed to render %s event for %s: %v\n", event.Type, w.config.URL, err)
+			continue
+		}
+		w.enqueue(delivery{event: event, body: body})
+	}
+}
+
+// enqueue adds a delivery to the queue, dropping it if the queue is full
+func (w *Webhook) enqueue(d delivery) {
+	select {
+	case w.queue <- d:
+		w.dropping.Store(false)
+	default:
+		metrics.Inc(metrics.WebhookDropped, d.event.RouteID)
+		if !w.dropping.Swap(true) {
+			fmt.Printf("Webhooks > Queue of %s is full, dropping events until it drains\n", w.config.URL)
+		}
+	}
+}
+
+// attempt sends a queued delivery once, scheduling a retry with exponential backoff on errors and 5xx/429 responses
+func (w *Webhook) attempt(d delivery) {
+	retry, err := w.send(d.event, d.body)
+	if err == nil {
+		return
+	}
+	if !retry || d.attempt >= w.config.MaxRetries {
+		fmt.Printf("Webhooks > Failed to deliver %s event to %s: %v\n", d.event.Type, w.config.URL, err)
+		return
+	}
+
+	delay := min(time.Second<<d.attempt, maxRetryDelay)
+	fmt.Printf("Webhooks > Delivery of %s event to %s failed (%v), retrying in %v\n", d.event.Type, w.config.URL, err, delay)
+	d.attempt++
+	time.AfterFunc(delay, func() {
+		w.enqueue(d)
+	})
+}
+
+func (w *Webhook) render(event events.Event) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(event)
+	}
+
+	var buf bytes.Buffer
+	err := w.template.Execute(&buf, event)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// send performs a single delivery attempt, reporting whether a failure is worth retrying
+func (w *Webhook) send(event events.Event, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tunnelled-webhook")
+	req.Header.Set("X-Tunnelled-Event", string(event.Type))
+	req.Header.Set("X-Tunnelled-Timestamp", timestamp)
+	if w.config.Secret != "" {
+		req.Header.Set("X-Tunnelled-Signature", "sha256="+Sign(w.config.Secret, timestamp, body))
+	}
+	for key, value := range w.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+}
+
+// Sign computes the hex HMAC-SHA256 of "<timestamp>.<body>" with the webhook secret
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}